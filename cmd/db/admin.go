@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+// handleBackup streams a consistent tar archive of the database segments.
+func handleBackup(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(rw)
+		return
+	}
+	snapshot, err := db.Snapshot()
+	if err != nil {
+		writeDbError(rw, err)
+		return
+	}
+	defer snapshot.Close()
+
+	// A large archive takes longer to send than the server write timeout allows.
+	disableWriteTimeout(rw)
+	name := fmt.Sprintf("backup-%s.tar", time.Now().UTC().Format("20060102T150405Z"))
+	setPositionHeaders(rw.Header(), snapshot.Position())
+	rw.Header().Set("Content-Type", "application/x-tar")
+	rw.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	err = snapshot.Backup(rw)
+	if err != nil {
+		// The status is already sent, the client sees a truncated archive.
+		log.Printf("Backup failed: %s", err)
+	}
+}
+
+// disableWriteTimeout lets a long response outlive the write timeout of the
+// server.
+func disableWriteTimeout(rw http.ResponseWriter) {
+	_ = http.NewResponseController(rw).SetWriteDeadline(time.Time{})
+}
+
+func restoreBackup(dir, path string, opts *datastore.Options) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = datastore.Restore(dir, f, opts)
+	if err != nil {
+		return err
+	}
+	log.Printf("Restored backup %s into %s", path, dir)
+	return nil
+}
+
+// handleStats reports the value cache counters and the state of compaction.
+func handleStats(rw http.ResponseWriter, r *http.Request) {
+	cache := db.CacheStats()
+	compaction := db.CompactionStatus()
+	var lastError string
+	if compaction.LastError != nil {
+		lastError = compaction.LastError.Error()
+	}
+	data := map[string]interface{}{
+		"cache": map[string]interface{}{
+			"hits":    cache.Hits,
+			"misses":  cache.Misses,
+			"entries": cache.Entries,
+			"bytes":   cache.Bytes,
+		},
+		"compaction": map[string]interface{}{
+			"running":        compaction.Running,
+			"runs":           compaction.Runs,
+			"lastDuration":   compaction.LastDuration.String(),
+			"lastError":      lastError,
+			"bytesReclaimed": compaction.BytesReclaimed,
+		},
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(data)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/roman-mazur/architecture-practice-4-template/dbclient"
+)
+
+func TestClient(t *testing.T) {
+	openTestDb(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/db/", handleDb)
+	mux.HandleFunc("/db", handleDbScan)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	client := dbclient.New(server.URL)
+	ctx := context.Background()
+
+	t.Run("put and get", func(t *testing.T) {
+		for key, value := range map[string]string{"k1": "v1", "k2": "v2", "dir/k3": "v 3&"} {
+			if err := client.Put(ctx, key, value); err != nil {
+				t.Fatalf("Cannot put %s: %s", key, err)
+			}
+			got, err := client.Get(ctx, key)
+			if err != nil {
+				t.Fatalf("Cannot get %s: %s", key, err)
+			}
+			if got != value {
+				t.Errorf("Bad value for %s: expected %q, got %q", key, value, got)
+			}
+		}
+	})
+
+	t.Run("scan", func(t *testing.T) {
+		keys, err := client.Scan(ctx, "k", "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(keys, []string{"k1", "k2"}) {
+			t.Errorf("Unexpected keys %v", keys)
+		}
+		keys, err = client.Scan(ctx, "", "k1", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(keys, []string{"k2"}) {
+			t.Errorf("Unexpected keys %v", keys)
+		}
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		applied, err := client.Batch(ctx, []dbclient.Operation{
+			dbclient.PutOp("b1", "x"),
+			dbclient.DeleteOp("k1"),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if applied != 2 {
+			t.Errorf("Expected 2 applied operations, got %d", applied)
+		}
+		if value, err := client.Get(ctx, "b1"); err != nil || value != "x" {
+			t.Errorf("Bad value after batch: %q, %v", value, err)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		if err := client.Delete(ctx, "k2"); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.Delete(ctx, "k2"); !errors.Is(err, dbclient.ErrNotFound) {
+			t.Errorf("Expected ErrNotFound deleting twice, got %v", err)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		_, err := client.Get(ctx, "k1")
+		if !errors.Is(err, dbclient.ErrNotFound) {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+		var apiErr *dbclient.Error
+		if !errors.As(err, &apiErr) || apiErr.Status != http.StatusNotFound || apiErr.Code != "not_found" {
+			t.Errorf("Unexpected error details %#v", apiErr)
+		}
+
+		if err := db.PutInt64("counter", 1); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Get(ctx, "counter"); !errors.Is(err, dbclient.ErrWrongType) {
+			t.Errorf("Expected ErrWrongType for an int64 value, got %v", err)
+		}
+		if err := client.Put(ctx, "empty", ""); !errors.Is(err, dbclient.ErrBadRequest) {
+			t.Errorf("Expected ErrBadRequest for an empty value, got %v", err)
+		}
+		if _, err := client.Batch(ctx, []dbclient.Operation{{Op: "bad", Key: "x"}}); !errors.Is(err, dbclient.ErrBadRequest) {
+			t.Errorf("Expected ErrBadRequest for a bad batch, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// keyOperation handles a request to /db/{key}/{operation}.
+type keyOperation struct {
+	method string
+	handle func(rw http.ResponseWriter, r *http.Request, key string)
+}
+
+var keyOperations = map[string]keyOperation{
+	"incr":      {http.MethodPost, handleDbIncr},
+	"lpush":     {http.MethodPost, handleListPush(true)},
+	"rpush":     {http.MethodPost, handleListPush(false)},
+	"lpop":      {http.MethodPost, handleListPop(true)},
+	"rpop":      {http.MethodPost, handleListPop(false)},
+	"hget":      {http.MethodGet, handleHashGet},
+	"hset":      {http.MethodPost, handleHashSet},
+	"hdel":      {http.MethodPost, handleHashDelete},
+	"sadd":      {http.MethodPost, handleSetAdd},
+	"srem":      {http.MethodPost, handleSetRemove},
+	"sismember": {http.MethodGet, handleSetIsMember},
+}
+
+// splitOperation separates a known operation name from the end of the request
+// path. It returns a nil operation for plain key requests.
+func splitOperation(path string) (string, *keyOperation) {
+	key := strings.TrimPrefix(path, "/db/")
+	i := strings.LastIndex(key, "/")
+	if i < 0 {
+		return key, nil
+	}
+	op, ok := keyOperations[key[i+1:]]
+	if !ok {
+		return key, nil
+	}
+	return key[:i], &op
+}
+
+func getList(key string) (interface{}, uint64, error) {
+	items, err := db.GetList(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	data := struct {
+		Key   string   `json:"key"`
+		Value []string `json:"value"`
+	}{key, items}
+	return data, 0, nil
+}
+
+func getHash(key string) (interface{}, uint64, error) {
+	fields, err := db.GetHash(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	data := struct {
+		Key   string            `json:"key"`
+		Value map[string]string `json:"value"`
+	}{key, fields}
+	return data, 0, nil
+}
+
+func getSet(key string) (interface{}, uint64, error) {
+	members, err := db.GetSet(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	data := struct {
+		Key   string   `json:"key"`
+		Value []string `json:"value"`
+	}{key, members}
+	return data, 0, nil
+}
+
+func putList(key, value string, ttl time.Duration) error {
+	if ttl > 0 {
+		return badInput("ttl is supported for strings only")
+	}
+	var items []string
+	err := json.Unmarshal([]byte(value), &items)
+	if err != nil {
+		return badInput("Bad list value, expected JSON array of strings")
+	}
+	if len(items) == 0 {
+		return badInput("Can't save empty list")
+	}
+	return db.PutList(key, items)
+}
+
+func putHash(key, value string, ttl time.Duration) error {
+	if ttl > 0 {
+		return badInput("ttl is supported for strings only")
+	}
+	var fields map[string]string
+	err := json.Unmarshal([]byte(value), &fields)
+	if err != nil {
+		return badInput("Bad hash value, expected JSON object with string values")
+	}
+	if len(fields) == 0 {
+		return badInput("Can't save empty hash")
+	}
+	return db.PutHash(key, fields)
+}
+
+func putSet(key, value string, ttl time.Duration) error {
+	if ttl > 0 {
+		return badInput("ttl is supported for strings only")
+	}
+	var members []string
+	err := json.Unmarshal([]byte(value), &members)
+	if err != nil {
+		return badInput("Bad set value, expected JSON array of strings")
+	}
+	if len(members) == 0 {
+		return badInput("Can't save empty set")
+	}
+	return db.PutSet(key, members)
+}
+
+// formValues returns all values of the form field, rejecting requests without any.
+func formValues(rw http.ResponseWriter, r *http.Request, name string) ([]string, bool) {
+	err := r.ParseForm()
+	if err != nil || len(r.Form[name]) == 0 {
+		badRequest(rw, fmt.Sprintf("Missing %s field", name))
+		return nil, false
+	}
+	return r.Form[name], true
+}
+
+func handleListPush(front bool) func(http.ResponseWriter, *http.Request, string) {
+	return func(rw http.ResponseWriter, r *http.Request, key string) {
+		values, ok := formValues(rw, r, "value")
+		if !ok {
+			return
+		}
+		length, err := db.ListPush(key, front, values...)
+		if err != nil {
+			writeDbError(rw, err)
+			return
+		}
+		data := struct {
+			Key    string `json:"key"`
+			Length int    `json:"length"`
+		}{key, length}
+		_ = json.NewEncoder(rw).Encode(data)
+	}
+}
+
+func handleListPop(front bool) func(http.ResponseWriter, *http.Request, string) {
+	return func(rw http.ResponseWriter, r *http.Request, key string) {
+		value, err := db.ListPop(key, front)
+		if err != nil {
+			writeDbError(rw, err)
+			return
+		}
+		data := struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+		}{key, value}
+		_ = json.NewEncoder(rw).Encode(data)
+	}
+}
+
+func handleHashGet(rw http.ResponseWriter, r *http.Request, key string) {
+	field := r.URL.Query().Get("field")
+	value, err := db.HashGet(key, field)
+	if err != nil {
+		writeDbError(rw, err)
+		return
+	}
+	data := struct {
+		Key   string `json:"key"`
+		Field string `json:"field"`
+		Value string `json:"value"`
+	}{key, field, value}
+	_ = json.NewEncoder(rw).Encode(data)
+}
+
+func handleHashSet(rw http.ResponseWriter, r *http.Request, key string) {
+	field := r.FormValue("field")
+	if field == "" {
+		badRequest(rw, "Missing field")
+		return
+	}
+	err := db.HashSet(key, field, r.FormValue("value"))
+	if err != nil {
+		writeDbError(rw, err)
+	}
+}
+
+func handleHashDelete(rw http.ResponseWriter, r *http.Request, key string) {
+	err := db.HashDelete(key, r.FormValue("field"))
+	if err != nil {
+		writeDbError(rw, err)
+	}
+}
+
+func handleSetAdd(rw http.ResponseWriter, r *http.Request, key string) {
+	members, ok := formValues(rw, r, "value")
+	if !ok {
+		return
+	}
+	count, err := db.SetAdd(key, members...)
+	writeSetCount(rw, key, count, err)
+}
+
+func handleSetRemove(rw http.ResponseWriter, r *http.Request, key string) {
+	members, ok := formValues(rw, r, "value")
+	if !ok {
+		return
+	}
+	count, err := db.SetRemove(key, members...)
+	writeSetCount(rw, key, count, err)
+}
+
+func writeSetCount(rw http.ResponseWriter, key string, count int, err error) {
+	if err != nil {
+		writeDbError(rw, err)
+		return
+	}
+	data := struct {
+		Key   string `json:"key"`
+		Count int    `json:"count"`
+	}{key, count}
+	_ = json.NewEncoder(rw).Encode(data)
+}
+
+func handleSetIsMember(rw http.ResponseWriter, r *http.Request, key string) {
+	member := r.URL.Query().Get("member")
+	ok, err := db.SetIsMember(key, member)
+	if err != nil {
+		writeDbError(rw, err)
+		return
+	}
+	data := struct {
+		Key      string `json:"key"`
+		Member   string `json:"member"`
+		IsMember bool   `json:"isMember"`
+	}{key, member, ok}
+	_ = json.NewEncoder(rw).Encode(data)
+}
@@ -2,10 +2,17 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/roman-mazur/architecture-practice-4-template/datastore"
 	"github.com/roman-mazur/architecture-practice-4-template/httptools"
@@ -13,98 +20,507 @@ import (
 )
 
 var port = flag.Int("port", 8100, "server port")
+var strictRecovery = flag.Bool("strict-recovery", false, "refuse to start if the active segment has a torn tail")
+var syncPolicy = flag.String("sync", "none", "fsync policy for writes: none, always or batch")
+var syncInterval = flag.Duration("sync-interval", datastore.DefaultSyncInterval, "group commit interval for the batch sync policy")
+var syncBytes = flag.Int64("sync-bytes", 0, "group commit size threshold for the batch sync policy (0 - interval only)")
+var maxValueSize = flag.Int64("max-value-size", 64<<20, "maximum size of a binary value in bytes")
+var restoreFrom = flag.String("restore", "", "load a backup archive into the empty data directory before starting")
+var leader = flag.String("leader", "", "run as a follower of the db service at this URL, e.g. http://db:8100")
+var dataDir = flag.String("dir", "./out", "directory with the database segment files")
+var segmentSize = flag.Int64("segment-size", datastore.OutfileSize, "size in bytes after which a new segment file is started")
+var mergeThreshold = flag.Int("merge-threshold", datastore.DefaultMergeThreshold, "number of sealed segments that triggers a merge")
+var segmentPrefix = flag.String("segment-prefix", "segment-", "file name prefix of the segment files")
+var cacheSize = flag.Int64("cache-size", 0, "memory in bytes for caching recently read values (0 - no cache)")
+var respPort = flag.Int("resp-port", 0, "port of the Redis protocol listener (0 - disabled)")
 var db *datastore.Db
 
 func main() {
 	flag.Parse()
 	h := new(http.ServeMux)
-	newDb, err := datastore.NewDb("./out")
+	opts := &datastore.Options{
+		SegmentSize:    *segmentSize,
+		MergeThreshold: *mergeThreshold,
+		SegmentPrefix:  *segmentPrefix,
+		Recovery:       datastore.RecoverTruncate,
+		CacheSize:      *cacheSize,
+	}
+	if *strictRecovery {
+		opts.Recovery = datastore.RecoverStrict
+	}
+	switch *syncPolicy {
+	case "none":
+		opts.Sync = datastore.SyncNone
+	case "always":
+		opts.Sync = datastore.SyncAlways
+	case "batch":
+		opts.Sync = datastore.SyncBatch
+		opts.SyncInterval = *syncInterval
+		opts.SyncBytes = *syncBytes
+	default:
+		panic(fmt.Sprintf("unknown sync policy: %s", *syncPolicy))
+	}
+	if *restoreFrom != "" && *leader != "" {
+		panic("-restore cannot be used with -leader")
+	}
+	if *restoreFrom != "" {
+		err := restoreBackup(*dataDir, *restoreFrom, opts)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if *leader != "" {
+		f, err := bootstrapFollower(*leader, *dataDir, opts)
+		if err != nil {
+			panic(err)
+		}
+		replica = f
+	}
+	newDb, err := datastore.NewDb(*dataDir, opts)
 	if err != nil {
 		panic(err)
 	}
 	db = newDb
 
-	h.HandleFunc("/db/", handleDb)
+	if replica != nil {
+		h.HandleFunc("/db/", redirectWrites(*leader, handleDb))
+		go replica.run(db)
+	} else {
+		h.HandleFunc("/db/", handleDb)
+	}
+	h.HandleFunc("/db", handleDbScan)
+	h.HandleFunc("/admin/backup", handleBackup)
+	h.HandleFunc("/admin/stats", handleStats)
+	h.HandleFunc("/replication/stream", handleReplicationStream)
+	h.HandleFunc("/replication/status", handleReplicationStatus)
 
 	server := httptools.CreateServer(*port, h)
 	server.Start()
+	if *respPort > 0 {
+		l, err := net.Listen("tcp", fmt.Sprintf(":%d", *respPort))
+		if err != nil {
+			panic(err)
+		}
+		go func() {
+			err := serveResp(l)
+			log.Fatalf("RESP listener finished: %s. Finishing the process.", err)
+		}()
+	}
 	signal.WaitForTerminationSignal()
+	// Closing releases the lock of the data directory, which outlives the
+	// process on platforms without advisory locks.
+	err = db.Close()
+	if err != nil {
+		log.Printf("Cannot close the database: %s", err)
+	}
 }
 
 func handleDb(rw http.ResponseWriter, r *http.Request) {
+	if key, op := splitOperation(r.URL.Path); op != nil {
+		if r.Method != op.method {
+			methodNotAllowed(rw)
+			return
+		}
+		op.handle(rw, r, key)
+		return
+	}
+
 	switch r.Method {
 	case http.MethodGet:
+		if r.URL.Path == "/db/_watch" {
+			handleDbWatch(rw, r)
+			return
+		}
 		handleDbGet(rw, r)
 	case http.MethodPost:
+		if r.URL.Path == "/db/_batch" {
+			handleDbBatch(rw, r)
+			return
+		}
 		handleDbPost(rw, r)
+	case http.MethodHead:
+		handleDbHead(rw, r)
+	case http.MethodDelete:
+		handleDbDelete(rw, r)
 	default:
-		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		methodNotAllowed(rw)
+	}
+}
+
+const defaultScanLimit = 100
+
+func handleDbScan(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(rw)
+		return
+	}
+	query := r.URL.Query()
+	limit := defaultScanLimit
+	if l := query.Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit <= 0 {
+			badRequest(rw, "Bad limit")
+			return
+		}
+	}
+
+	keys, err := db.Scan(query.Get("prefix"), query.Get("after"), limit)
+	if err != nil {
+		writeDbError(rw, err)
+		return
+	}
+	if keys == nil {
+		keys = []string{}
+	}
+	data := struct {
+		Keys []string `json:"keys"`
+	}{keys}
+	_ = json.NewEncoder(rw).Encode(data)
+}
+
+// handleDbHead checks that the key exists without reading its value.
+func handleDbHead(rw http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/db/")
+	version, err := db.Version(key)
+	if errors.Is(err, datastore.ErrNotFound) {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
 	}
+	rw.Header().Set("ETag", formatETag(version))
+	rw.WriteHeader(http.StatusOK)
+}
+
+func handleDbDelete(rw http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/db/")
+	err := db.Delete(key)
+	if err != nil {
+		writeDbError(rw, err)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
 }
 
 func handleDbGet(rw http.ResponseWriter, r *http.Request) {
 	key := strings.TrimPrefix(r.URL.Path, "/db/")
 	t := r.URL.Query().Get("type")
+	if t == "bytes" {
+		handleDbGetBytes(rw, key)
+		return
+	}
 	getter := typeToGetter(t)
 	if getter == nil {
-		http.Error(rw, "Unknown data type", http.StatusBadRequest)
+		badRequest(rw, "Unknown data type")
 		return
 	}
-	data, err := getter(key)
+	data, version, err := getter(key)
 
 	if err != nil {
-		http.Error(rw, err.Error(), http.StatusBadRequest)
+		writeDbError(rw, err)
 	} else {
+		if version != 0 {
+			rw.Header().Set("ETag", formatETag(version))
+		}
 		_ = json.NewEncoder(rw).Encode(data)
 	}
 }
 
-func typeToGetter(t string) func(string) (interface{}, error) {
+func typeToGetter(t string) func(string) (interface{}, uint64, error) {
 	if t == "" || t == "string" {
 		return get
+	} else if t == "int64" {
+		return getInt64
+	} else if t == "list" {
+		return getList
+	} else if t == "hash" {
+		return getHash
+	} else if t == "set" {
+		return getSet
 	} else {
 		return nil
 	}
 }
 
-func get(key string) (interface{}, error) {
-	value, err := db.Get(key)
+func getInt64(key string) (interface{}, uint64, error) {
+	value, err := db.GetInt64(key)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
+	}
+	data := struct {
+		Key   string `json:"key"`
+		Value int64  `json:"value"`
+	}{key, value}
+	return data, 0, nil
+}
+
+func get(key string) (interface{}, uint64, error) {
+	value, version, err := db.GetWithVersion(key)
+	if err != nil {
+		return nil, 0, err
 	}
 	data := struct {
 		Key   string `json:"key"`
 		Value string `json:"value"`
 	}{key, value}
-	return data, nil
+	return data, version, nil
+}
+
+// handleDbGetBytes streams a binary value directly from the segment file.
+func handleDbGetBytes(rw http.ResponseWriter, key string) {
+	value, err := db.OpenValue(key)
+	if err != nil {
+		writeDbError(rw, err)
+		return
+	}
+	defer value.Close()
+
+	rw.Header().Set("Content-Type", "application/octet-stream")
+	rw.Header().Set("Content-Length", strconv.FormatInt(value.Size(), 10))
+	rw.Header().Set("ETag", formatETag(value.Version()))
+	_, err = io.Copy(rw, value)
+	if err != nil {
+		log.Printf("Failed to stream value of %s: %s", key, err)
+	}
+}
+
+// handleDbPostBytes saves the raw request body as a binary value.
+func handleDbPostBytes(rw http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/db/")
+	if t := r.URL.Query().Get("type"); t != "" && t != "bytes" {
+		badRequest(rw, "Binary body can be saved as bytes only")
+		return
+	}
+	value, err := io.ReadAll(http.MaxBytesReader(rw, r.Body, *maxValueSize))
+	if err != nil {
+		writeDbError(rw, err)
+		return
+	}
+	if len(value) == 0 {
+		badRequest(rw, "Can't save empty value")
+		return
+	}
+	err = db.PutBytes(key, value)
+	if err != nil {
+		writeDbError(rw, err)
+	}
 }
 
 func handleDbPost(rw http.ResponseWriter, r *http.Request) {
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/octet-stream" {
+		handleDbPostBytes(rw, r)
+		return
+	}
 	key := strings.TrimPrefix(r.URL.Path, "/db/")
 	value := r.FormValue("value")
 	t := r.URL.Query().Get("type")
 	putter := typeToPutter(t)
 	if putter == nil {
-		http.Error(rw, "Unknown data type", http.StatusBadRequest)
+		badRequest(rw, "Unknown data type")
+		return
+	}
+	ttl, err := parseTTL(r.FormValue("ttl"))
+	if err != nil {
+		writeDbError(rw, err)
 		return
 	}
-	err := putter(key, value)
+	if r.Header.Get("If-Match") != "" || r.Header.Get("If-None-Match") != "" {
+		if ttl != 0 {
+			badRequest(rw, "Conditional writes don't support ttl")
+			return
+		}
+		if t != "" && t != "string" {
+			badRequest(rw, "Conditional writes are supported for strings only")
+			return
+		}
+		handleDbConditionalPost(rw, r, key, value)
+		return
+	}
+	err = putter(key, value, ttl)
+	if err != nil {
+		writeDbError(rw, err)
+	}
+}
+
+// parseTTL accepts either a duration like "1m30s" or a number of seconds.
+func parseTTL(ttl string) (time.Duration, error) {
+	if ttl == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(ttl)
 	if err != nil {
-		http.Error(rw, err.Error(), http.StatusBadRequest)
+		seconds, convErr := strconv.Atoi(ttl)
+		if convErr != nil {
+			return 0, badInput("Bad ttl: " + ttl)
+		}
+		d = time.Duration(seconds) * time.Second
+	}
+	if d <= 0 {
+		return 0, badInput("Bad ttl: " + ttl)
+	}
+	return d, nil
+}
+
+// handleDbConditionalPost saves a string value only if the version of the key
+// matches the If-Match header, or if the key doesn't exist when If-None-Match is "*".
+func handleDbConditionalPost(rw http.ResponseWriter, r *http.Request, key, value string) {
+	if value == "" {
+		badRequest(rw, "Can't save empty value")
+		return
+	}
+
+	var expected uint64
+	if ifMatch := r.Header.Get("If-Match"); ifMatch == "*" {
+		_, version, err := db.GetWithVersion(key)
+		if err == datastore.ErrNotFound {
+			preconditionFailed(rw)
+			return
+		} else if err != nil {
+			writeDbError(rw, err)
+			return
+		}
+		expected = version
+	} else if ifMatch != "" {
+		version, ok := parseETag(ifMatch)
+		if !ok {
+			badRequest(rw, "Bad If-Match header")
+			return
+		}
+		expected = version
+	} else if r.Header.Get("If-None-Match") != "*" {
+		badRequest(rw, "Only \"*\" is supported in If-None-Match")
+		return
+	}
+
+	version, err := db.CompareAndSwap(key, expected, value)
+	if err == datastore.ErrVersionMismatch {
+		preconditionFailed(rw)
+		return
+	} else if err != nil {
+		writeDbError(rw, err)
+		return
+	}
+	rw.Header().Set("ETag", formatETag(version))
+}
+
+func formatETag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+func parseETag(etag string) (uint64, bool) {
+	if len(etag) < 2 || etag[0] != '"' || etag[len(etag)-1] != '"' {
+		return 0, false
 	}
+	version, err := strconv.ParseUint(etag[1:len(etag)-1], 10, 64)
+	return version, err == nil
 }
 
-func typeToPutter(t string) func(string, string) error {
+func typeToPutter(t string) func(string, string, time.Duration) error {
 	if t == "" || t == "string" {
 		return put
+	} else if t == "int64" {
+		return putInt64
+	} else if t == "list" {
+		return putList
+	} else if t == "hash" {
+		return putHash
+	} else if t == "set" {
+		return putSet
 	} else {
 		return nil
 	}
 }
 
-func put(key, value string) error {
+func putInt64(key, value string, ttl time.Duration) error {
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return badInput("Bad int64 value: " + value)
+	}
+	if ttl > 0 {
+		return badInput("ttl is supported for strings only")
+	}
+	return db.PutInt64(key, n)
+}
+
+func handleDbIncr(rw http.ResponseWriter, r *http.Request, key string) {
+	delta := int64(1)
+	if d := r.FormValue("delta"); d != "" {
+		var err error
+		delta, err = strconv.ParseInt(d, 10, 64)
+		if err != nil {
+			badRequest(rw, "Bad delta")
+			return
+		}
+	}
+
+	value, err := db.Incr(key, delta)
+	if err != nil {
+		writeDbError(rw, err)
+		return
+	}
+	data := struct {
+		Key   string `json:"key"`
+		Value int64  `json:"value"`
+	}{key, value}
+	_ = json.NewEncoder(rw).Encode(data)
+}
+
+func put(key, value string, ttl time.Duration) error {
 	if value == "" {
-		return fmt.Errorf("Can't save empty value")
+		return badInput("Can't save empty value")
+	}
+	if ttl > 0 {
+		return db.PutWithTTL(key, value, ttl)
 	}
 	return db.Put(key, value)
 }
+
+type batchOperation struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+func handleDbBatch(rw http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Operations []batchOperation `json:"operations"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		badRequest(rw, "Bad batch body: "+err.Error())
+		return
+	}
+
+	batch := db.NewBatch()
+	for _, op := range request.Operations {
+		if op.Key == "" {
+			badRequest(rw, "Can't use empty key")
+			return
+		}
+		switch op.Op {
+		case "put":
+			if op.Value == "" {
+				badRequest(rw, "Can't save empty value")
+				return
+			}
+			batch.Put(op.Key, op.Value)
+		case "delete":
+			batch.Delete(op.Key)
+		default:
+			badRequest(rw, fmt.Sprintf("Unknown batch operation: %s", op.Op))
+			return
+		}
+	}
+
+	err = batch.Commit()
+	if err != nil {
+		writeDbError(rw, err)
+		return
+	}
+	data := struct {
+		Applied int `json:"applied"`
+	}{batch.Len()}
+	_ = json.NewEncoder(rw).Encode(data)
+}
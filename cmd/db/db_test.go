@@ -0,0 +1,599 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+func openTestDb(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-cmd-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newDb, err := datastore.NewDb(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = newDb
+	t.Cleanup(func() {
+		db.Close()
+		os.RemoveAll(dir)
+	})
+}
+
+func TestHandleDbScan(t *testing.T) {
+	openTestDb(t)
+	for _, key := range []string{"b", "a", "c", "ab"} {
+		if err := db.Put(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rw := httptest.NewRecorder()
+	handleDbScan(rw, httptest.NewRequest(http.MethodGet, "/db?prefix=a&limit=10", nil))
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Unexpected status %d", rw.Code)
+	}
+	var resp struct {
+		Keys []string `json:"keys"`
+	}
+	if err := json.NewDecoder(rw.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(resp.Keys, []string{"a", "ab"}) {
+		t.Errorf("Unexpected keys %v", resp.Keys)
+	}
+
+	rw = httptest.NewRecorder()
+	handleDbScan(rw, httptest.NewRequest(http.MethodGet, "/db?after=ab&limit=1", nil))
+	if err := json.NewDecoder(rw.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(resp.Keys, []string{"b"}) {
+		t.Errorf("Unexpected page %v", resp.Keys)
+	}
+
+	rw = httptest.NewRecorder()
+	handleDbScan(rw, httptest.NewRequest(http.MethodGet, "/db?limit=-1", nil))
+	if rw.Code != http.StatusBadRequest {
+		t.Errorf("Expected bad request for negative limit, got %d", rw.Code)
+	}
+}
+
+func TestHandleDbBatch(t *testing.T) {
+	openTestDb(t)
+	if err := db.Put("removed", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	body := `{"operations": [
+		{"op": "put", "key": "key1", "value": "value1"},
+		{"op": "delete", "key": "removed"}
+	]}`
+	rw := httptest.NewRecorder()
+	handleDb(rw, httptest.NewRequest(http.MethodPost, "/db/_batch", strings.NewReader(body)))
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Unexpected status %d: %s", rw.Code, rw.Body)
+	}
+	if value, err := db.Get("key1"); err != nil || value != "value1" {
+		t.Errorf("Bad value for key1: %s, %v", value, err)
+	}
+	if _, err := db.Get("removed"); err != datastore.ErrNotFound {
+		t.Errorf("Expected removed key to be deleted, got %v", err)
+	}
+
+	body = `{"operations": [
+		{"op": "put", "key": "key2", "value": "value2"},
+		{"op": "rename", "key": "key1"}
+	]}`
+	rw = httptest.NewRecorder()
+	handleDb(rw, httptest.NewRequest(http.MethodPost, "/db/_batch", strings.NewReader(body)))
+	if rw.Code != http.StatusBadRequest {
+		t.Errorf("Expected bad request for unknown operation, got %d", rw.Code)
+	}
+	if _, err := db.Get("key2"); err != datastore.ErrNotFound {
+		t.Errorf("Rejected batch was partially applied: %v", err)
+	}
+}
+
+func TestHandleDbConditionalPost(t *testing.T) {
+	openTestDb(t)
+	post := func(value string, header, etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/db/key", strings.NewReader("value="+value))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if header != "" {
+			req.Header.Set(header, etag)
+		}
+		rw := httptest.NewRecorder()
+		handleDb(rw, req)
+		return rw
+	}
+
+	rw := post("value1", "If-None-Match", "*")
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Cannot create key: %d %s", rw.Code, rw.Body)
+	}
+	etag := rw.Header().Get("ETag")
+
+	if rw := post("value2", "If-None-Match", "*"); rw.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 for existing key, got %d", rw.Code)
+	}
+
+	rw = httptest.NewRecorder()
+	handleDb(rw, httptest.NewRequest(http.MethodGet, "/db/key", nil))
+	if rw.Header().Get("ETag") != etag {
+		t.Errorf("GET returned ETag %s, expected %s", rw.Header().Get("ETag"), etag)
+	}
+
+	if rw := post("value2", "If-Match", etag); rw.Code != http.StatusOK {
+		t.Errorf("Cannot update key with matching ETag: %d %s", rw.Code, rw.Body)
+	}
+	if rw := post("value3", "If-Match", etag); rw.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 for stale ETag, got %d", rw.Code)
+	}
+	if value, _ := db.Get("key"); value != "value2" {
+		t.Errorf("Unexpected value %s", value)
+	}
+}
+
+func TestHandleDbPostTTL(t *testing.T) {
+	openTestDb(t)
+	post := func(ttl string) int {
+		req := httptest.NewRequest(http.MethodPost, "/db/session", strings.NewReader("value=data&ttl="+ttl))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rw := httptest.NewRecorder()
+		handleDb(rw, req)
+		return rw.Code
+	}
+
+	if code := post("abc"); code != http.StatusBadRequest {
+		t.Errorf("Expected bad request for invalid ttl, got %d", code)
+	}
+	if code := post("50ms"); code != http.StatusOK {
+		t.Fatalf("Cannot save key with ttl: %d", code)
+	}
+	if _, err := db.Get("session"); err != nil {
+		t.Errorf("Cannot get key before expiry: %s", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err := db.Get("session"); err != datastore.ErrNotFound {
+		t.Errorf("Expected key to expire, got %v", err)
+	}
+}
+
+func TestHandleDbInt64(t *testing.T) {
+	openTestDb(t)
+	send := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rw := httptest.NewRecorder()
+		handleDb(rw, req)
+		return rw
+	}
+	var resp struct {
+		Value int64 `json:"value"`
+	}
+
+	if rw := send(http.MethodPost, "/db/counter?type=int64", "value=10"); rw.Code != http.StatusOK {
+		t.Fatalf("Cannot save int64: %d %s", rw.Code, rw.Body)
+	}
+	if rw := send(http.MethodPost, "/db/counter?type=int64", "value=ten"); rw.Code != http.StatusBadRequest {
+		t.Errorf("Expected bad request for non-numeric value, got %d", rw.Code)
+	}
+
+	rw := send(http.MethodPost, "/db/counter/incr", "delta=5")
+	if err := json.NewDecoder(rw.Body).Decode(&resp); err != nil || resp.Value != 15 {
+		t.Errorf("Unexpected incr result %d, %v", resp.Value, err)
+	}
+	rw = send(http.MethodPost, "/db/counter/incr", "")
+	if err := json.NewDecoder(rw.Body).Decode(&resp); err != nil || resp.Value != 16 {
+		t.Errorf("Unexpected incr result %d, %v", resp.Value, err)
+	}
+
+	rw = send(http.MethodGet, "/db/counter?type=int64", "")
+	if err := json.NewDecoder(rw.Body).Decode(&resp); err != nil || resp.Value != 16 {
+		t.Errorf("Unexpected int64 value %d, %v", resp.Value, err)
+	}
+}
+
+func TestHandleDbBytes(t *testing.T) {
+	openTestDb(t)
+	blob := []byte{0, 1, 2, 0xff, 0, 'x'}
+
+	req := httptest.NewRequest(http.MethodPost, "/db/blob", bytes.NewReader(blob))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	rw := httptest.NewRecorder()
+	handleDb(rw, req)
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Cannot save binary value: %d %s", rw.Code, rw.Body)
+	}
+
+	rw = httptest.NewRecorder()
+	handleDb(rw, httptest.NewRequest(http.MethodGet, "/db/blob?type=bytes", nil))
+	if rw.Code != http.StatusOK || !bytes.Equal(rw.Body.Bytes(), blob) {
+		t.Errorf("Bad binary value returned: %d %v", rw.Code, rw.Body.Bytes())
+	}
+	if rw.Header().Get("Content-Type") != "application/octet-stream" || rw.Header().Get("Content-Length") != "6" {
+		t.Errorf("Unexpected headers %v", rw.Header())
+	}
+}
+
+func TestHandleDbCollections(t *testing.T) {
+	openTestDb(t)
+	send := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rw := httptest.NewRecorder()
+		handleDb(rw, req)
+		return rw
+	}
+
+	if rw := send(http.MethodPost, "/db/queue/rpush", "value=a&value=b"); rw.Code != http.StatusOK {
+		t.Fatalf("Cannot push to list: %d %s", rw.Code, rw.Body)
+	}
+	send(http.MethodPost, "/db/queue/lpush", "value=first")
+	var list struct {
+		Value []string `json:"value"`
+	}
+	rw := send(http.MethodGet, "/db/queue?type=list", "")
+	if err := json.NewDecoder(rw.Body).Decode(&list); err != nil || !reflect.DeepEqual(list.Value, []string{"first", "a", "b"}) {
+		t.Errorf("Unexpected list %v, %v", list.Value, err)
+	}
+	var popped struct {
+		Value string `json:"value"`
+	}
+	rw = send(http.MethodPost, "/db/queue/rpop", "")
+	if err := json.NewDecoder(rw.Body).Decode(&popped); err != nil || popped.Value != "b" {
+		t.Errorf("Unexpected popped value %s, %v", popped.Value, err)
+	}
+
+	if rw := send(http.MethodPost, "/db/user?type=hash", `value={"name":"bob"}`); rw.Code != http.StatusOK {
+		t.Fatalf("Cannot save hash: %d %s", rw.Code, rw.Body)
+	}
+	send(http.MethodPost, "/db/user/hset", "field=age&value=30")
+	rw = send(http.MethodGet, "/db/user/hget?field=age", "")
+	if err := json.NewDecoder(rw.Body).Decode(&popped); err != nil || popped.Value != "30" {
+		t.Errorf("Unexpected hash field %s, %v", popped.Value, err)
+	}
+
+	var count struct {
+		Count int `json:"count"`
+	}
+	rw = send(http.MethodPost, "/db/tags/sadd", "value=x&value=y&value=x")
+	if err := json.NewDecoder(rw.Body).Decode(&count); err != nil || count.Count != 2 {
+		t.Errorf("Unexpected added count %d, %v", count.Count, err)
+	}
+	var member struct {
+		IsMember bool `json:"isMember"`
+	}
+	rw = send(http.MethodGet, "/db/tags/sismember?member=y", "")
+	if err := json.NewDecoder(rw.Body).Decode(&member); err != nil || !member.IsMember {
+		t.Errorf("Expected y to be a member, %v", err)
+	}
+
+	if rw := send(http.MethodPost, "/db/tags/lpush", "value=z"); rw.Code != http.StatusConflict {
+		t.Errorf("Expected conflict for wrong type, got %d", rw.Code)
+	}
+	if rw := send(http.MethodGet, "/db/tags/sadd", ""); rw.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected method not allowed, got %d", rw.Code)
+	}
+}
+
+func TestHandleBackup(t *testing.T) {
+	openTestDb(t)
+	if err := db.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	rw := httptest.NewRecorder()
+	handleBackup(rw, httptest.NewRequest(http.MethodGet, "/admin/backup", nil))
+	if rw.Code != http.StatusOK || rw.Header().Get("Content-Type") != "application/x-tar" {
+		t.Fatalf("Unexpected backup response %d %v", rw.Code, rw.Header())
+	}
+
+	dir := t.TempDir()
+	if err := datastore.Restore(dir, rw.Body, nil); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := datastore.NewDb(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	if value, err := restored.Get("key"); err != nil || value != "value" {
+		t.Errorf("Bad restored value %s, %v", value, err)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	openTestDb(t)
+	if err := db.Put("before", "value"); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/backup", handleBackup)
+	mux.HandleFunc("/replication/stream", handleReplicationStream)
+	leader := httptest.NewServer(mux)
+	defer leader.Close()
+
+	dir := t.TempDir()
+	f, err := bootstrapFollower(leader.URL, dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, err := datastore.NewDb(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	if value, err := local.Get("before"); err != nil || value != "value" {
+		t.Errorf("Bootstrapped follower has bad value %s, %v", value, err)
+	}
+
+	done := make(chan error)
+	go func() { done <- f.stream(local) }()
+	if err := db.Put("after", "value2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("before"); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := local.Get("before")
+		if err == datastore.ErrNotFound {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Follower didn't catch up with the leader")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if value, err := local.Get("after"); err != nil || value != "value2" {
+		t.Errorf("Bad replicated value %s, %v", value, err)
+	}
+	if status := f.status(); status.Lag != 0 || status.Applied != db.FeedPosition().Index {
+		t.Errorf("Unexpected follower status %+v", status)
+	}
+	leader.CloseClientConnections()
+	<-done
+
+	rw := httptest.NewRecorder()
+	redirectWrites(leader.URL, handleDb)(rw, httptest.NewRequest(http.MethodPost, "/db/key?type=string", nil))
+	if rw.Code != http.StatusTemporaryRedirect || rw.Header().Get("Location") != leader.URL+"/db/key?type=string" {
+		t.Errorf("Expected redirect to the leader, got %d %s", rw.Code, rw.Header().Get("Location"))
+	}
+}
+
+func TestHandleStats(t *testing.T) {
+	openTestDb(t)
+	rw := httptest.NewRecorder()
+	handleStats(rw, httptest.NewRequest(http.MethodGet, "/admin/stats", nil))
+	var resp struct {
+		Cache struct {
+			Hits   uint64 `json:"hits"`
+			Misses uint64 `json:"misses"`
+		} `json:"cache"`
+		Compaction struct {
+			Runs int `json:"runs"`
+		} `json:"compaction"`
+	}
+	if err := json.NewDecoder(rw.Body).Decode(&resp); err != nil {
+		t.Fatalf("Cannot decode stats: %s", err)
+	}
+	if resp.Cache.Hits != 0 || resp.Compaction.Runs != 0 {
+		t.Errorf("Unexpected stats of a new db %+v", resp)
+	}
+}
+
+func TestHandleDbDeleteHead(t *testing.T) {
+	openTestDb(t)
+	if err := db.PutInt64("counter", 1); err != nil {
+		t.Fatal(err)
+	}
+	send := func(method string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		handleDb(rw, httptest.NewRequest(method, "/db/counter", nil))
+		return rw
+	}
+
+	if rw := send(http.MethodHead); rw.Code != http.StatusOK || rw.Header().Get("ETag") == "" || rw.Body.Len() != 0 {
+		t.Errorf("Unexpected HEAD response %d %v %q", rw.Code, rw.Header(), rw.Body)
+	}
+	if rw := send(http.MethodDelete); rw.Code != http.StatusNoContent {
+		t.Errorf("Cannot delete key: %d %s", rw.Code, rw.Body)
+	}
+	if rw := send(http.MethodHead); rw.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for deleted key, got %d", rw.Code)
+	}
+	if rw := send(http.MethodDelete); rw.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 when deleting missing key, got %d", rw.Code)
+	}
+}
+
+func TestHandleDbErrors(t *testing.T) {
+	openTestDb(t)
+	if err := db.PutInt64("counter", 1); err != nil {
+		t.Fatal(err)
+	}
+	oldMax := *maxValueSize
+	*maxValueSize = 4
+	t.Cleanup(func() { *maxValueSize = oldMax })
+
+	for _, tc := range []struct {
+		name, method, target, contentType, body string
+		status                                  int
+		code                                    string
+	}{
+		{"missing key", http.MethodGet, "/db/missing", "", "", http.StatusNotFound, "not_found"},
+		{"wrong type", http.MethodGet, "/db/counter", "", "", http.StatusConflict, "wrong_type"},
+		{"bad ttl", http.MethodPost, "/db/key", "application/x-www-form-urlencoded", "value=v&ttl=abc", http.StatusBadRequest, "bad_request"},
+		{"bad list", http.MethodPost, "/db/key?type=list", "application/x-www-form-urlencoded", "value=[]", http.StatusBadRequest, "bad_request"},
+		{"too large", http.MethodPost, "/db/blob", "application/octet-stream", "0123456789", http.StatusRequestEntityTooLarge, "value_too_large"},
+		{"method", http.MethodPut, "/db/key", "", "", http.StatusMethodNotAllowed, "method_not_allowed"},
+	} {
+		req := httptest.NewRequest(tc.method, tc.target, strings.NewReader(tc.body))
+		if tc.contentType != "" {
+			req.Header.Set("Content-Type", tc.contentType)
+		}
+		rw := httptest.NewRecorder()
+		handleDb(rw, req)
+
+		var resp errorResponse
+		if err := json.NewDecoder(rw.Body).Decode(&resp); err != nil {
+			t.Errorf("%s: cannot decode error body: %s", tc.name, err)
+			continue
+		}
+		if rw.Code != tc.status || resp.Error.Code != tc.code || resp.Error.Message == "" {
+			t.Errorf("%s: got %d %+v, expected %d %s", tc.name, rw.Code, resp.Error, tc.status, tc.code)
+		}
+		if rw.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%s: unexpected content type %s", tc.name, rw.Header().Get("Content-Type"))
+		}
+	}
+}
+
+func TestHandleDbWatch(t *testing.T) {
+	openTestDb(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/db/", handleDb)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/db/_watch?prefix=user:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); resp.StatusCode != http.StatusOK || ct != "text/event-stream" {
+		t.Fatalf("Unexpected response %d, %s", resp.StatusCode, ct)
+	}
+
+	if err := db.Put("item:1", "x"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("user:1", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("user:1"); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := bufio.NewScanner(resp.Body)
+	readEvent := func() (id, event, data string) {
+		t.Helper()
+		for lines.Scan() {
+			line := lines.Text()
+			switch {
+			case line == "" && event != "":
+				return id, event, data
+			case strings.HasPrefix(line, "id: "):
+				id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				data = strings.TrimPrefix(line, "data: ")
+			}
+		}
+		t.Fatalf("Stream ended: %v", lines.Err())
+		return
+	}
+	var ids []string
+	for _, expected := range []string{"put", "delete"} {
+		id, event, data := readEvent()
+		if event != expected || !strings.Contains(data, `"key":"user:1"`) {
+			t.Errorf("Expected %s of user:1, got %s %s", expected, event, data)
+		}
+		ids = append(ids, id)
+	}
+
+	// Reconnecting with the id of the put delivers the changes after it.
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/db/_watch?prefix=user:", nil)
+	req.Header.Set("Last-Event-ID", ids[0])
+	resumed, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resumed.Body.Close()
+	lines = bufio.NewScanner(resumed.Body)
+	if id, event, _ := readEvent(); event != "delete" || id != ids[1] {
+		t.Errorf("Expected resumed delete with id %s, got %s %s", ids[1], event, id)
+	}
+
+	// Only the last event of a batch moves the id past the batch.
+	batch := db.NewBatch()
+	batch.Put("user:2", "b")
+	batch.Put("user:3", "c")
+	if err := batch.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	first, _, _ := readEvent()
+	last, _, _ := readEvent()
+	if first != ids[1] || last == first {
+		t.Errorf("Unexpected ids of batch events %s, %s after %s", first, last, ids[1])
+	}
+
+	gone, err := http.Get(server.URL + "/db/_watch?epoch=1&from=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gone.Body.Close()
+	if gone.StatusCode != http.StatusGone {
+		t.Errorf("Expected 410 for an unknown epoch, got %d", gone.StatusCode)
+	}
+}
+
+func TestBootstrapFollowerLockedDir(t *testing.T) {
+	openTestDb(t)
+	if err := db.Put("leader", "value"); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/backup", handleBackup)
+	leader := httptest.NewServer(mux)
+	defer leader.Close()
+
+	dir := t.TempDir()
+	local, err := datastore.NewDb(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := local.Put("local", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bootstrapFollower(leader.URL, dir, nil); !errors.Is(err, datastore.ErrLocked) {
+		t.Errorf("Expected ErrLocked for a directory in use, got %v", err)
+	}
+	if value, err := local.Get("local"); err != nil || value != "value" {
+		t.Errorf("Data of the running Db was touched: %s, %v", value, err)
+	}
+	local.Close()
+
+	// Once the directory is free, its content is replaced with the backup.
+	if _, err := bootstrapFollower(leader.URL, dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	local, err = datastore.NewDb(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	if _, err := local.Get("local"); err != datastore.ErrNotFound {
+		t.Errorf("Expected old data to be replaced, got %v", err)
+	}
+	if value, err := local.Get("leader"); err != nil || value != "value" {
+		t.Errorf("Bad bootstrapped value %s, %v", value, err)
+	}
+}
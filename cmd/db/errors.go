@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+// Error codes sent in the body of error responses.
+const (
+	codeBadRequest         = "bad_request"
+	codeNotFound           = "not_found"
+	codeMethodNotAllowed   = "method_not_allowed"
+	codeWrongType          = "wrong_type"
+	codeOverflow           = "overflow"
+	codePreconditionFailed = "precondition_failed"
+	codeValueTooLarge      = "value_too_large"
+	codeFeedGone           = "feed_gone"
+	codeCorruptRecord      = "corrupt_record"
+	codeInternal           = "internal"
+)
+
+// errorResponse is the body of every error response:
+// {"error": {"code": "not_found", "message": "record does not exist"}}.
+type errorResponse struct {
+	Error errorDetails `json:"error"`
+}
+
+type errorDetails struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// badInput is an error caused by the request rather than by the datastore.
+type badInput string
+
+func (e badInput) Error() string {
+	return string(e)
+}
+
+func writeError(rw http.ResponseWriter, status int, code, message string) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(errorResponse{errorDetails{code, message}})
+}
+
+func badRequest(rw http.ResponseWriter, message string) {
+	writeError(rw, http.StatusBadRequest, codeBadRequest, message)
+}
+
+func methodNotAllowed(rw http.ResponseWriter) {
+	writeError(rw, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+}
+
+func preconditionFailed(rw http.ResponseWriter) {
+	writeError(rw, http.StatusPreconditionFailed, codePreconditionFailed, "Precondition failed")
+}
+
+// writeDbError responds with the status and the code matching an error
+// returned while handling a request. Unknown errors are reported as internal.
+func writeDbError(rw http.ResponseWriter, err error) {
+	var (
+		input    badInput
+		tooLarge *http.MaxBytesError
+		corrupt  *datastore.ErrCorruptRecord
+	)
+	switch {
+	case errors.As(err, &input):
+		badRequest(rw, err.Error())
+	case errors.Is(err, datastore.ErrNotFound):
+		writeError(rw, http.StatusNotFound, codeNotFound, err.Error())
+	case errors.Is(err, datastore.ErrWrongType):
+		writeError(rw, http.StatusConflict, codeWrongType, err.Error())
+	case errors.Is(err, datastore.ErrOverflow):
+		writeError(rw, http.StatusConflict, codeOverflow, err.Error())
+	case errors.Is(err, datastore.ErrVersionMismatch):
+		preconditionFailed(rw)
+	case errors.As(err, &tooLarge):
+		writeError(rw, http.StatusRequestEntityTooLarge, codeValueTooLarge, err.Error())
+	case errors.Is(err, datastore.ErrFeedGone):
+		writeError(rw, http.StatusGone, codeFeedGone, err.Error())
+	case errors.As(err, &corrupt):
+		log.Printf("Corrupt record: %s", err)
+		writeError(rw, http.StatusInternalServerError, codeCorruptRecord, err.Error())
+	default:
+		log.Printf("Request failed: %s", err)
+		writeError(rw, http.StatusInternalServerError, codeInternal, err.Error())
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+const (
+	epochHeader = "X-Replication-Epoch"
+	indexHeader = "X-Replication-Index"
+
+	// streamBatch is the number of records read from the feed at once.
+	streamBatch = 256
+	// heartbeatInterval is how often an idle stream tells the follower the leader head.
+	heartbeatInterval = time.Second
+	// frameHeaderSize is the size of [index u64][head u64][length u32] before every record.
+	frameHeaderSize = 20
+)
+
+// replica is the follower state, nil when the service is the leader.
+var replica *follower
+
+func setPositionHeaders(h http.Header, pos datastore.Position) {
+	h.Set(epochHeader, strconv.FormatUint(pos.Epoch, 10))
+	h.Set(indexHeader, strconv.FormatUint(pos.Index, 10))
+}
+
+func parsePosition(epoch, index string) (datastore.Position, error) {
+	var pos datastore.Position
+	var err error
+	pos.Epoch, err = strconv.ParseUint(epoch, 10, 64)
+	if err != nil {
+		return pos, badInput(fmt.Sprintf("bad epoch %q", epoch))
+	}
+	pos.Index, err = strconv.ParseUint(index, 10, 64)
+	if err != nil {
+		return pos, badInput(fmt.Sprintf("bad index %q", index))
+	}
+	return pos, nil
+}
+
+// handleReplicationStream sends records of the change feed starting from the
+// requested position. Every record is sent in a frame with its feed index and
+// the current feed head. Frames without a record are heartbeats.
+func handleReplicationStream(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(rw)
+		return
+	}
+	query := r.URL.Query()
+	pos, err := parsePosition(query.Get("epoch"), query.Get("from"))
+	if err != nil {
+		writeDbError(rw, err)
+		return
+	}
+
+	flusher, _ := rw.(http.Flusher)
+	out := bufio.NewWriter(rw)
+	for started := false; ; started = true {
+		ctx, cancel := context.WithTimeout(r.Context(), heartbeatInterval)
+		records, err := db.ReadChanges(ctx, pos, streamBatch)
+		cancel()
+		if errors.Is(err, datastore.ErrFeedGone) && !started {
+			// The follower has to bootstrap again.
+			writeDbError(rw, err)
+			return
+		}
+		if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+			return
+		}
+		if !started {
+			disableWriteTimeout(rw)
+			rw.Header().Set("Content-Type", "application/octet-stream")
+		}
+
+		head := db.FeedPosition().Index
+		if len(records) == 0 {
+			writeFrame(out, pos.Index, head, nil)
+		}
+		for _, data := range records {
+			writeFrame(out, pos.Index, head, data)
+			pos.Index++
+		}
+		if out.Flush() != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+func writeFrame(w io.Writer, index, head uint64, data []byte) {
+	var header [frameHeaderSize]byte
+	binary.LittleEndian.PutUint64(header[:], index)
+	binary.LittleEndian.PutUint64(header[8:], head)
+	binary.LittleEndian.PutUint32(header[16:], uint32(len(data)))
+	w.Write(header[:])
+	w.Write(data)
+}
+
+type replicationStatus struct {
+	Role        string     `json:"role"`
+	Leader      string     `json:"leader,omitempty"`
+	Epoch       uint64     `json:"epoch"`
+	Applied     uint64     `json:"applied"`
+	LeaderHead  uint64     `json:"leaderHead"`
+	Lag         uint64     `json:"lag"`
+	LastContact *time.Time `json:"lastContact,omitempty"`
+}
+
+func handleReplicationStatus(rw http.ResponseWriter, r *http.Request) {
+	var status replicationStatus
+	if replica != nil {
+		status = replica.status()
+	} else {
+		head := db.FeedPosition()
+		status = replicationStatus{Role: "leader", Epoch: head.Epoch, Applied: head.Index, LeaderHead: head.Index}
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(status)
+}
+
+// redirectWrites sends all requests except reads to the leader.
+func redirectWrites(leader string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			handler(rw, r)
+			return
+		}
+		http.Redirect(rw, r, leader+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	}
+}
+
+// follower replays the change feed of the leader into the local Db.
+type follower struct {
+	leader string
+	client *http.Client
+
+	mu          sync.Mutex
+	pos         datastore.Position
+	leaderHead  uint64
+	lastContact time.Time
+}
+
+// bootstrapFollower replaces the data directory with a backup of the leader
+// and returns a follower that continues from the position of the backup. The
+// follower keeps no state of its own, so it starts over on every launch.
+func bootstrapFollower(leader, dir string, opts *datastore.Options) (*follower, error) {
+	f := &follower{leader: leader, client: http.DefaultClient}
+	resp, err := f.client.Get(leader + "/admin/backup")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("leader backup request failed: %s", resp.Status)
+	}
+	f.pos, err = parsePosition(resp.Header.Get(epochHeader), resp.Header.Get(indexHeader))
+	if err != nil {
+		return nil, fmt.Errorf("leader backup has no replication position: %w", err)
+	}
+
+	// The backup is restored next to the data directory, so that a failed
+	// download keeps the old data and a running Db keeps its directory.
+	temp, err := os.MkdirTemp(filepath.Dir(filepath.Clean(dir)), filepath.Base(dir)+".bootstrap-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(temp)
+	err = datastore.Restore(temp, resp.Body, opts)
+	if err != nil {
+		return nil, err
+	}
+	err = datastore.Replace(dir, temp)
+	if err != nil {
+		return nil, err
+	}
+	f.leaderHead = f.pos.Index
+	f.lastContact = time.Now()
+	log.Printf("Bootstrapped follower from %s at index %d", leader, f.pos.Index)
+	return f, nil
+}
+
+func (f *follower) status() replicationStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	lastContact := f.lastContact
+	return replicationStatus{
+		Role:        "follower",
+		Leader:      f.leader,
+		Epoch:       f.pos.Epoch,
+		Applied:     f.pos.Index,
+		LeaderHead:  f.leaderHead,
+		Lag:         f.leaderHead - min(f.leaderHead, f.pos.Index),
+		LastContact: &lastContact,
+	}
+}
+
+// run keeps streaming from the leader into local, reconnecting after network
+// errors. If the leader can't continue from our position, the process exits,
+// so it is restarted and bootstrapped again.
+func (f *follower) run(local *datastore.Db) {
+	for {
+		err := f.stream(local)
+		if errors.Is(err, datastore.ErrFeedGone) {
+			// The directory lock has to be released for the restart.
+			local.Close()
+			log.Fatalf("Replication position is lost, restart to bootstrap again: %s", err)
+		}
+		log.Printf("Replication stream from %s failed: %s", f.leader, err)
+		time.Sleep(heartbeatInterval)
+	}
+}
+
+func (f *follower) stream(local *datastore.Db) error {
+	f.mu.Lock()
+	pos := f.pos
+	f.mu.Unlock()
+	url := fmt.Sprintf("%s/replication/stream?epoch=%d&from=%d", f.leader, pos.Epoch, pos.Index)
+	resp, err := f.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		return datastore.ErrFeedGone
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("leader responded with %s", resp.Status)
+	}
+
+	in := bufio.NewReader(resp.Body)
+	var header [frameHeaderSize]byte
+	for {
+		_, err := io.ReadFull(in, header[:])
+		if err != nil {
+			return err
+		}
+		index := binary.LittleEndian.Uint64(header[:])
+		head := binary.LittleEndian.Uint64(header[8:])
+		data := make([]byte, binary.LittleEndian.Uint32(header[16:]))
+		_, err = io.ReadFull(in, data)
+		if err != nil {
+			return err
+		}
+		if index != pos.Index {
+			return fmt.Errorf("unexpected record index %d, expected %d", index, pos.Index)
+		}
+		if len(data) > 0 {
+			err = local.ApplyRecord(data)
+			if err != nil {
+				return err
+			}
+			pos.Index++
+		}
+
+		f.mu.Lock()
+		f.pos = pos
+		f.leaderHead = head
+		f.lastContact = time.Now()
+		f.mu.Unlock()
+	}
+}
@@ -0,0 +1,537 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+const (
+	// respMaxArgs limits the number of elements of a command array.
+	respMaxArgs = 1 << 20
+	// respMaxInline limits the length of an inline command line.
+	respMaxInline = 64 << 10
+	// respScanCount is the number of keys a SCAN call returns when COUNT is not set.
+	respScanCount = 10
+	// respMaxCursors is the number of unfinished SCAN iterations kept at once.
+	respMaxCursors = 4096
+)
+
+// respError is an error reply. Its text starts with the error kind, e.g. "ERR" or "WRONGTYPE".
+type respError string
+
+func (e respError) Error() string {
+	return string(e)
+}
+
+// respCommand is a command of the RESP listener. arity is the number of
+// arguments including the command name, negative for "at least -arity".
+type respCommand struct {
+	arity  int
+	write  bool
+	handle func(w *respConn, args []string)
+}
+
+var respCommands = map[string]respCommand{
+	"ping":   {-1, false, respPing},
+	"get":    {2, false, respGet},
+	"set":    {-3, true, respSet},
+	"del":    {-2, true, respDel},
+	"exists": {-2, false, respExists},
+	"incr":   {2, true, respIncr},
+	"scan":   {-2, false, respScan},
+}
+
+// respConn is a client connection of the RESP listener.
+type respConn struct {
+	respWriter
+	// cursors are the SCAN iterations of all connections of the listener,
+	// as clients with connection pools continue them on other connections.
+	cursors *scanCursors
+}
+
+// serveResp accepts connections of Redis clients speaking the RESP2 protocol
+// until the listener is closed.
+func serveResp(l net.Listener) error {
+	cursors := newScanCursors()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go handleRespConn(conn, cursors)
+	}
+}
+
+func handleRespConn(conn net.Conn, cursors *scanCursors) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := &respConn{respWriter{bufio.NewWriter(conn)}, cursors}
+	for {
+		args, err := readRespCommand(r)
+		if err != nil {
+			var protoErr respError
+			if errors.As(err, &protoErr) {
+				w.error(protoErr)
+				_ = w.w.Flush()
+			} else if err != io.EOF {
+				log.Printf("RESP connection %s failed: %s", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		name := strings.ToLower(args[0])
+		if name == "quit" {
+			w.simple("OK")
+			_ = w.w.Flush()
+			return
+		}
+		runRespCommand(w, name, args)
+		// Replies to pipelined commands are sent together.
+		if r.Buffered() == 0 {
+			if err := w.w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func runRespCommand(w *respConn, name string, args []string) {
+	cmd, ok := respCommands[name]
+	switch {
+	case !ok:
+		w.error(respError(fmt.Sprintf("ERR unknown command '%s'", args[0])))
+	case cmd.arity > 0 && len(args) != cmd.arity, cmd.arity < 0 && len(args) < -cmd.arity:
+		w.error(respError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", name)))
+	case cmd.write && replica != nil:
+		w.error("READONLY You can't write against a read only replica.")
+	default:
+		cmd.handle(w, args[1:])
+	}
+}
+
+// readRespCommand reads a command sent either as an array of bulk strings or
+// as an inline line of space separated words.
+func readRespCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readRespLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if line == "" || line[0] != '*' {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > respMaxArgs {
+		return nil, respError("ERR Protocol error: invalid multibulk length")
+	}
+	args := make([]string, 0, max(n, 0))
+	for i := 0; i < n; i++ {
+		line, err = readRespLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if line == "" || line[0] != '$' {
+			return nil, respError(fmt.Sprintf("ERR Protocol error: expected '$', got '%.1s'", line))
+		}
+		size, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil || size < 0 || size > *maxValueSize {
+			return nil, respError("ERR Protocol error: invalid bulk length")
+		}
+		data := make([]byte, size+2)
+		_, err = io.ReadFull(r, data)
+		if err != nil {
+			return nil, err
+		}
+		if string(data[size:]) != "\r\n" {
+			return nil, respError("ERR Protocol error: bulk string is not terminated by CRLF")
+		}
+		args = append(args, string(data[:size]))
+	}
+	return args, nil
+}
+
+// readRespLine reads a line terminated by CRLF or LF without the terminator.
+func readRespLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, isPrefix, err := r.ReadLine()
+		if err != nil {
+			if err == io.EOF && len(line) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		line = append(line, chunk...)
+		if len(line) > respMaxInline {
+			return "", respError("ERR Protocol error: too big inline request")
+		}
+		if !isPrefix {
+			return string(line), nil
+		}
+	}
+}
+
+// respWriter encodes RESP2 replies.
+type respWriter struct {
+	w *bufio.Writer
+}
+
+func (w *respWriter) simple(s string) {
+	w.w.WriteString("+" + s + "\r\n")
+}
+
+func (w *respWriter) error(err respError) {
+	w.w.WriteString("-" + strings.NewReplacer("\r", " ", "\n", " ").Replace(string(err)) + "\r\n")
+}
+
+func (w *respWriter) integer(n int64) {
+	w.w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (w *respWriter) bulk(s string) {
+	w.w.WriteString("$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n")
+}
+
+func (w *respWriter) null() {
+	w.w.WriteString("$-1\r\n")
+}
+
+func (w *respWriter) arrayHeader(n int) {
+	w.w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+// dbError replies with the Redis error matching a datastore error.
+func (w *respWriter) dbError(err error) {
+	switch {
+	case errors.Is(err, datastore.ErrWrongType):
+		w.error("WRONGTYPE Operation against a key holding the wrong kind of value")
+	case errors.Is(err, datastore.ErrOverflow):
+		w.error("ERR increment or decrement would overflow")
+	default:
+		log.Printf("RESP command failed: %s", err)
+		w.error(respError("ERR " + err.Error()))
+	}
+}
+
+func respPing(w *respConn, args []string) {
+	switch len(args) {
+	case 0:
+		w.simple("PONG")
+	case 1:
+		w.bulk(args[0])
+	default:
+		w.error("ERR wrong number of arguments for 'ping' command")
+	}
+}
+
+// respGet replies with the value of a string, int64 or binary key, as Redis
+// keeps all of them as strings.
+func respGet(w *respConn, args []string) {
+	value, err := db.Get(args[0])
+	if errors.Is(err, datastore.ErrWrongType) {
+		var n int64
+		n, err = db.GetInt64(args[0])
+		value = strconv.FormatInt(n, 10)
+	}
+	if errors.Is(err, datastore.ErrWrongType) {
+		var data []byte
+		data, err = db.GetBytes(args[0])
+		value = string(data)
+	}
+	switch {
+	case errors.Is(err, datastore.ErrNotFound):
+		w.null()
+	case err != nil:
+		w.dbError(err)
+	default:
+		w.bulk(value)
+	}
+}
+
+// respSet handles SET key value [EX seconds | PX milliseconds].
+func respSet(w *respConn, args []string) {
+	var ttl time.Duration
+	for i := 2; i < len(args); i += 2 {
+		unit := time.Second
+		switch strings.ToLower(args[i]) {
+		case "ex":
+		case "px":
+			unit = time.Millisecond
+		default:
+			w.error("ERR syntax error")
+			return
+		}
+		if i+1 == len(args) || ttl != 0 {
+			w.error("ERR syntax error")
+			return
+		}
+		n, err := strconv.ParseInt(args[i+1], 10, 64)
+		if err != nil || n <= 0 || n > int64(time.Duration(1<<62)/unit) {
+			w.error("ERR invalid expire time in 'set' command")
+			return
+		}
+		ttl = time.Duration(n) * unit
+	}
+
+	var err error
+	if ttl > 0 {
+		err = db.PutWithTTL(args[0], args[1], ttl)
+	} else {
+		err = db.Put(args[0], args[1])
+	}
+	if err != nil {
+		w.dbError(err)
+		return
+	}
+	w.simple("OK")
+}
+
+func respDel(w *respConn, keys []string) {
+	var deleted int64
+	for _, key := range keys {
+		err := db.Delete(key)
+		if errors.Is(err, datastore.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			w.dbError(err)
+			return
+		}
+		deleted++
+	}
+	w.integer(deleted)
+}
+
+func respExists(w *respConn, keys []string) {
+	var found int64
+	for _, key := range keys {
+		_, err := db.Version(key)
+		if errors.Is(err, datastore.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			w.dbError(err)
+			return
+		}
+		found++
+	}
+	w.integer(found)
+}
+
+// respIncr increments an int64 key or a string key holding an integer.
+func respIncr(w *respConn, args []string) {
+	value, err := db.Incr(args[0], 1)
+	if errors.Is(err, datastore.ErrWrongType) {
+		if _, getErr := db.Get(args[0]); getErr == nil {
+			w.error("ERR value is not an integer or out of range")
+			return
+		}
+	}
+	if err != nil {
+		w.dbError(err)
+		return
+	}
+	w.integer(value)
+}
+
+// scanCursors maps numeric SCAN cursors to the last key returned by the
+// previous call of the iteration. Redis clients expect numeric cursors while
+// datastore scans continue after a key.
+type scanCursors struct {
+	mu    sync.Mutex
+	next  uint64
+	keys  map[uint64]string
+	order []uint64
+}
+
+func newScanCursors() *scanCursors {
+	return &scanCursors{next: 1, keys: make(map[uint64]string)}
+}
+
+// save returns a new cursor continuing after key, dropping the oldest cursors
+// when there are too many.
+func (c *scanCursors) save(key string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.order) >= respMaxCursors {
+		delete(c.keys, c.order[0])
+		c.order = c.order[1:]
+	}
+	cursor := c.next
+	c.next++
+	c.keys[cursor] = key
+	c.order = append(c.order, cursor)
+	return cursor
+}
+
+// load returns the key saved for the cursor. Cursor 0 starts a new iteration.
+func (c *scanCursors) load(cursor uint64) (string, bool) {
+	if cursor == 0 {
+		return "", true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key, ok := c.keys[cursor]
+	return key, ok
+}
+
+// respScan handles SCAN cursor [MATCH pattern] [COUNT count].
+func respScan(w *respConn, args []string) {
+	cursor, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		w.error("ERR invalid cursor")
+		return
+	}
+	after, ok := w.cursors.load(cursor)
+	if !ok {
+		w.error("ERR invalid cursor")
+		return
+	}
+
+	pattern := ""
+	count := respScanCount
+	for i := 1; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			w.error("ERR syntax error")
+			return
+		}
+		switch strings.ToLower(args[i]) {
+		case "match":
+			pattern = args[i+1]
+		case "count":
+			count, err = strconv.Atoi(args[i+1])
+			if err != nil || count <= 0 {
+				w.error("ERR value is not an integer or out of range")
+				return
+			}
+		default:
+			w.error("ERR syntax error")
+			return
+		}
+	}
+
+	prefix := ""
+	if pattern != "" {
+		prefix = globPrefix(pattern)
+	}
+	keys, err := db.Scan(prefix, after, count)
+	if err != nil {
+		w.dbError(err)
+		return
+	}
+	var nextCursor uint64
+	if len(keys) == count {
+		nextCursor = w.cursors.save(keys[len(keys)-1])
+	}
+	matched := keys[:0]
+	for _, key := range keys {
+		if pattern == "" || globMatch(pattern, key) {
+			matched = append(matched, key)
+		}
+	}
+
+	w.arrayHeader(2)
+	w.bulk(strconv.FormatUint(nextCursor, 10))
+	w.arrayHeader(len(matched))
+	for _, key := range matched {
+		w.bulk(key)
+	}
+}
+
+// globPrefix returns the literal beginning of a glob pattern.
+func globPrefix(pattern string) string {
+	i := strings.IndexAny(pattern, `*?[\`)
+	if i < 0 {
+		return pattern
+	}
+	return pattern[:i]
+}
+
+// globMatch reports whether s matches a Redis glob pattern with *, ?, [...]
+// character classes and \ escapes.
+func globMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if pattern == "" {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if globMatch(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if s == "" {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+		case '[':
+			if s == "" {
+				return false
+			}
+			rest, ok := matchClass(pattern[1:], s[0])
+			if !ok {
+				return false
+			}
+			pattern, s = rest, s[1:]
+		default:
+			if pattern[0] == '\\' && len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			if s == "" || pattern[0] != s[0] {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+		}
+	}
+	return s == ""
+}
+
+// matchClass matches c against the class that starts after '[' and returns
+// the pattern after the closing ']'.
+func matchClass(pattern string, c byte) (string, bool) {
+	negate := len(pattern) > 0 && pattern[0] == '^'
+	if negate {
+		pattern = pattern[1:]
+	}
+	matched := false
+	for len(pattern) > 0 && pattern[0] != ']' {
+		lo := pattern[0]
+		if lo == '\\' && len(pattern) > 1 {
+			pattern = pattern[1:]
+			lo = pattern[0]
+		}
+		pattern = pattern[1:]
+		hi := lo
+		if len(pattern) > 1 && pattern[0] == '-' && pattern[1] != ']' {
+			hi = pattern[1]
+			pattern = pattern[2:]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+		}
+		if lo <= c && c <= hi {
+			matched = true
+		}
+	}
+	if len(pattern) > 0 {
+		pattern = pattern[1:]
+	}
+	return pattern, matched != negate
+}
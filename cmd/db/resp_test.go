@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// respRequest encodes a command as an array of bulk strings.
+func respRequest(args ...string) string {
+	request := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		request += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return request
+}
+
+func TestRespListener(t *testing.T) {
+	openTestDb(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serveResp(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// expect sends the request and checks the exact bytes of the reply.
+	expect := func(request, reply string) {
+		t.Helper()
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.WriteString(conn, request); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(reply))
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Fatalf("Cannot read reply to %q: %s", request, err)
+		}
+		if string(got) != reply {
+			t.Errorf("Bad reply to %q: expected %q, got %q", request, reply, got)
+		}
+	}
+
+	expect(respRequest("PING"), "+PONG\r\n")
+	expect("PING hello\r\n", "$5\r\nhello\r\n")
+	expect(respRequest("GET", "k"), "$-1\r\n")
+	expect(respRequest("SET", "k", "v\r\n1"), "+OK\r\n")
+	expect(respRequest("GET", "k"), "$4\r\nv\r\n1\r\n")
+	expect(respRequest("SET", "t", "v", "PX", "60000"), "+OK\r\n")
+	expect(respRequest("SET", "t", "v", "EX"), "-ERR syntax error\r\n")
+	expect(respRequest("EXISTS", "k", "t", "missing"), ":2\r\n")
+
+	expect(respRequest("INCR", "n"), ":1\r\n")
+	expect(respRequest("INCR", "n"), ":2\r\n")
+	expect(respRequest("GET", "n"), "$1\r\n2\r\n")
+	expect(respRequest("INCR", "k"), "-ERR value is not an integer or out of range\r\n")
+	expect(respRequest("SET", "s", "10"), "+OK\r\n")
+	expect(respRequest("INCR", "s"), ":11\r\n")
+	expect(respRequest("GET", "s"), "$2\r\n11\r\n")
+
+	if err := db.PutList("l", []string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	expect(respRequest("INCR", "l"), "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n")
+
+	expect(respRequest("DEL", "k", "missing"), ":1\r\n")
+	expect(respRequest("GET", "k"), "$-1\r\n")
+
+	expect(respRequest("GET"), "-ERR wrong number of arguments for 'get' command\r\n")
+	expect(respRequest("FLUSHALL"), "-ERR unknown command 'FLUSHALL'\r\n")
+
+	// Pipelined commands are answered in order.
+	expect(respRequest("SET", "p", "1")+respRequest("GET", "p"), "+OK\r\n$1\r\n1\r\n")
+
+	t.Run("scan", func(t *testing.T) {
+		for _, key := range []string{"user:1", "user:2", "user:3", "item:1"} {
+			if err := db.Put(key, "x"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		expect(respRequest("SCAN", "0", "MATCH", "user:*", "COUNT", "2"),
+			"*2\r\n$1\r\n1\r\n*2\r\n$6\r\nuser:1\r\n$6\r\nuser:2\r\n")
+		expect(respRequest("SCAN", "1", "MATCH", "user:*", "COUNT", "2"),
+			"*2\r\n$1\r\n0\r\n*1\r\n$6\r\nuser:3\r\n")
+		expect(respRequest("SCAN", "0", "MATCH", "*:1"),
+			"*2\r\n$1\r\n0\r\n*2\r\n$6\r\nitem:1\r\n$6\r\nuser:1\r\n")
+		expect(respRequest("SCAN", "12345"), "-ERR invalid cursor\r\n")
+	})
+
+	expect(respRequest("QUIT"), "+OK\r\n")
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected the connection to be closed after QUIT, got %v", err)
+	}
+}
+
+func TestRespProtocolError(t *testing.T) {
+	openTestDb(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serveResp(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, "*1\r\n+PING\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(reply), "-ERR Protocol error") {
+		t.Errorf("Expected a protocol error, got %q", reply)
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"*", "anything", true},
+		{"user:*", "user:1", true},
+		{"user:*", "item:1", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{"*:1", "user:1", true},
+	} {
+		if got := globMatch(tc.pattern, tc.s); got != tc.match {
+			t.Errorf("globMatch(%q, %q) = %v", tc.pattern, tc.s, got)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+// handleDbWatch streams changes of the keys with the prefix as server-sent
+// events. The id of an event is the "epoch-index" feed position to resume
+// from after it, so a client reconnecting with Last-Event-ID gets the changes
+// made since. Only a batch received in part is sent again. A client that
+// falls behind gets a "cutoff" event with the position to resume from and
+// the stream ends.
+func handleDbWatch(rw http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var (
+		watcher *datastore.Watcher
+		err     error
+	)
+	switch {
+	case query.Get("epoch") != "":
+		var pos datastore.Position
+		pos, err = parsePosition(query.Get("epoch"), query.Get("from"))
+		if err == nil {
+			watcher, err = db.WatchFrom(query.Get("prefix"), pos)
+		}
+	case r.Header.Get("Last-Event-ID") != "":
+		epoch, index, _ := strings.Cut(r.Header.Get("Last-Event-ID"), "-")
+		var pos datastore.Position
+		pos, err = parsePosition(epoch, index)
+		if err == nil {
+			watcher, err = db.WatchFrom(query.Get("prefix"), pos)
+		}
+	default:
+		watcher = db.Watch(query.Get("prefix"))
+	}
+	if err != nil {
+		writeDbError(rw, err)
+		return
+	}
+	defer watcher.Close()
+
+	disableWriteTimeout(rw)
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.WriteHeader(http.StatusOK)
+	flusher, _ := rw.(http.Flusher)
+	out := bufio.NewWriter(rw)
+	flush := func() bool {
+		if out.Flush() != nil {
+			return false
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return true
+	}
+	if !flush() {
+		return
+	}
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(out, ": heartbeat\n\n")
+			if !flush() {
+				return
+			}
+		case ev, ok := <-watcher.C:
+			if !ok {
+				if errors.Is(watcher.Err(), datastore.ErrWatchLagging) {
+					pos := watcher.Position()
+					writeEvent(out, "", "cutoff", struct {
+						Epoch uint64 `json:"epoch"`
+						From  uint64 `json:"from"`
+					}{pos.Epoch, pos.Index})
+					flush()
+				}
+				return
+			}
+			// A reconnect continues after the last event, or repeats the
+			// batch if only a part of it was received.
+			next := ev.Position.Index
+			if ev.Last {
+				next++
+			}
+			id := fmt.Sprintf("%d-%d", ev.Position.Epoch, next)
+			writeEvent(out, id, string(ev.Type), struct {
+				Key     string `json:"key"`
+				Version uint64 `json:"version"`
+			}{ev.Key, ev.Version})
+			// Events that are already waiting are sent together.
+			if len(watcher.C) == 0 && !flush() {
+				return
+			}
+		}
+	}
+}
+
+func writeEvent(out *bufio.Writer, id, event string, data interface{}) {
+	if id != "" {
+		fmt.Fprintf(out, "id: %s\n", id)
+	}
+	payload, _ := json.Marshal(data)
+	fmt.Fprintf(out, "event: %s\ndata: %s\n\n", event, payload)
+}
@@ -2,14 +2,14 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
-	"io"
-	"io/ioutil"
 	"net/http"
-	"net/url"
 	"sync"
 	"time"
 
+	"github.com/roman-mazur/architecture-practice-4-template/dbclient"
 	"github.com/roman-mazur/architecture-practice-4-template/httptools"
 	"github.com/roman-mazur/architecture-practice-4-template/signal"
 )
@@ -43,10 +43,13 @@ func (c *boolMutex) Get() bool {
 
 var report Report
 
+var client *dbclient.Client
+
 func main() {
 	flag.Parse()
 	h := new(http.ServeMux)
 	health := boolMutex{v: *healthInit}
+	client = dbclient.New(scheme + "://" + *dbUrl)
 	writeTeam()
 
 	if *debug {
@@ -82,12 +85,8 @@ func main() {
 }
 
 func writeTeam() {
-	path := scheme + "://" + *dbUrl + "/db/" + team
-	formData := url.Values{}
-	formData.Set("value", time.Now().Format("2006-01-02"))
-
-	resp, err := http.PostForm(path, formData)
-	if err != nil || resp.StatusCode != http.StatusOK {
+	err := client.Put(context.Background(), team, time.Now().Format("2006-01-02"))
+	if err != nil {
 		panic("Can't initiate DB")
 	}
 }
@@ -95,36 +94,25 @@ func writeTeam() {
 func handleDefaultGet(rw http.ResponseWriter, r *http.Request) {
 	key := r.URL.Query().Get("key")
 
-	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(10)*time.Second)
-	defer cancel()
-	fwdRequest := r.Clone(ctx)
-	fwdRequest.RequestURI = ""
-	fwdRequest.URL.Host = *dbUrl
-	fwdRequest.Host = *dbUrl
-	fwdRequest.URL.Scheme = scheme
-	fwdRequest.URL.Path = "/db/" + key
-
-	resp, err := http.DefaultClient.Do(fwdRequest)
+	value, err := client.Get(r.Context(), key)
 	if *delay > 0 && *delay < 300 {
 		time.Sleep(time.Duration(*delay) * time.Millisecond)
 	}
+	if errors.Is(err, dbclient.ErrNotFound) {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if resp.StatusCode == http.StatusBadRequest {
-		body, err := ioutil.ReadAll(resp.Body)
-		if err == nil && string(body) == "record does not exist\n" {
-			rw.WriteHeader(http.StatusNotFound)
-			return
-		}
-	}
 
 	report.Process(r)
 
-	rw.WriteHeader(resp.StatusCode)
-	rw.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
-	rw.Header().Set("Content-Length", resp.Header.Get("Content-Length"))
-	io.Copy(rw, resp.Body)
-	resp.Body.Close()
+	data := struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+	}{key, value}
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(data)
 }
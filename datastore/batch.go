@@ -0,0 +1,93 @@
+package datastore
+
+import (
+	"encoding/binary"
+)
+
+// batchHeaderSize is the offset of the first nested record in a batch frame:
+// the frame is a record with an empty key and the nested records as its value.
+const batchHeaderSize = 8 + TYPE_SIZE + VERSION_SIZE + EXPIRY_SIZE + 4
+
+// Batch collects writes that are committed to the Db atomically: after a
+// crash either all of them are recovered or none.
+type Batch struct {
+	db      *Db
+	entries []entry
+}
+
+func (db *Db) NewBatch() *Batch {
+	return &Batch{db: db}
+}
+
+func (b *Batch) Put(key, value string) {
+	b.entries = append(b.entries, entry{key: key, vType: ToByte("string"), value: value})
+}
+
+func (b *Batch) Delete(key string) {
+	b.entries = append(b.entries, entry{key: key, vType: ToByte("delete")})
+}
+
+// Len returns the number of operations in the batch.
+func (b *Batch) Len() int {
+	return len(b.entries)
+}
+
+// Commit writes all operations of the batch as one record group.
+func (b *Batch) Commit() error {
+	if len(b.entries) == 0 {
+		return nil
+	}
+	keys := make([]string, len(b.entries))
+	for i := range b.entries {
+		keys[i] = b.entries[i].key
+	}
+	defer b.db.lockKeys(keys...)()
+
+	for i := range b.entries {
+		b.entries[i].version = b.db.nextVersion()
+	}
+	frame := encodeBatch(b.entries)
+	err := b.db.writeActive(func(bl *block) error {
+		return bl.writeBatch(frame)
+	})
+	if err != nil {
+		return err
+	}
+	b.db.cache.invalidate(keys...)
+	b.db.feed.append(frame)
+	return nil
+}
+
+func encodeBatch(entries []entry) []byte {
+	var payload []byte
+	for i := range entries {
+		payload = append(payload, entries[i].Encode()...)
+	}
+	frame := entry{vType: BATCH_TYPE, value: string(payload)}
+	return frame.Encode()
+}
+
+// batchRecords calls fn for every record nested in a verified batch frame,
+// passing the record position relative to the start of the frame.
+func batchRecords(frame []byte, fn func(pos int64, e *entry)) error {
+	end := len(frame) - CHECKSUM_SIZE
+	for pos := batchHeaderSize; pos < end; {
+		if pos+4 > end {
+			return errChecksum
+		}
+		size := int(binary.LittleEndian.Uint32(frame[pos:]))
+		if pos+size > end {
+			return errChecksum
+		}
+		data := frame[pos : pos+size]
+		err := verifyRecord(data)
+		if err != nil {
+			return err
+		}
+		var e entry
+		e.Decode(data)
+		fn(int64(pos), &e)
+		pos += size
+	}
+	return nil
+}
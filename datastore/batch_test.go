@@ -0,0 +1,98 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBatch_Commit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("removed", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	batch := db.NewBatch()
+	batch.Put("key1", "value1")
+	batch.Put("key2", "value2")
+	batch.Delete("removed")
+	if err := batch.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(db *Db) {
+		for _, key := range []string{"key1", "key2"} {
+			value, err := db.Get(key)
+			if err != nil || value != "value"+key[3:] {
+				t.Errorf("Bad value for %s: %s, %v", key, value, err)
+			}
+		}
+		if _, err := db.Get("removed"); err != ErrNotFound {
+			t.Errorf("Expected removed key to be deleted, got %v", err)
+		}
+	}
+	check(db)
+	db.Close()
+
+	db, err = NewDb(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check(db)
+}
+
+func TestBatch_TornFrame(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-batch-torn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key1", "old"); err != nil {
+		t.Fatal(err)
+	}
+	batch := db.NewBatch()
+	batch.Put("key1", "new")
+	batch.Put("key2", "new")
+	if err := batch.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// Cut the file in the middle of the second nested record of the batch.
+	segmentPath := filepath.Join(dir, outFile+"1")
+	info, err := os.Stat(segmentPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(segmentPath, info.Size()-10); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDb(dir, &Options{Recovery: RecoverTruncate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if value, err := db.Get("key1"); err != nil || value != "old" {
+		t.Errorf("Partial batch was applied: %s, %v", value, err)
+	}
+	if _, err := db.Get("key2"); err != ErrNotFound {
+		t.Errorf("Partial batch was applied: %v", err)
+	}
+}
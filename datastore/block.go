@@ -2,55 +2,225 @@ package datastore
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 )
 
 var ErrNotFound = fmt.Errorf("record does not exist")
 
+// ErrWrongType is returned when a value is read or modified as a type other than the stored one.
+var ErrWrongType = fmt.Errorf("wrong type of value")
+
+// ErrCorruptRecord is returned when a record in a segment file is truncated
+// or its checksum does not match the stored data.
+type ErrCorruptRecord struct {
+	Segment string
+	Offset  int64
+
+	// tail tells that the broken record runs to the end of the segment, as
+	// a record torn by a crash in the middle of a write does.
+	tail bool
+}
+
+func (e *ErrCorruptRecord) Error() string {
+	return fmt.Sprintf("corrupt record in segment %s at offset %d", e.Segment, e.Offset)
+}
+
+// Every segment file starts with segmentMagic followed by the format version
+// as a little endian uint32. The records follow the header.
+const (
+	segmentMagic      = "DSEG"
+	segmentFormat     = 1
+	segmentHeaderSize = 8
+)
+
+// ErrSegmentFormat is returned when a segment file was not written in the
+// current format, e.g. by an older version of the datastore. Such a segment
+// can't be read, and it isn't treated as corrupt either.
+type ErrSegmentFormat struct {
+	Segment string
+	// Version is the format version of the segment, 0 if it has no header.
+	Version uint32
+}
+
+func (e *ErrSegmentFormat) Error() string {
+	if e.Version == 0 {
+		return fmt.Sprintf("segment %s has no format header: it was written by an older version of the datastore and has to be migrated", e.Segment)
+	}
+	return fmt.Sprintf("segment %s has format version %d, supported version is %d", e.Segment, e.Version, segmentFormat)
+}
+
+func segmentHeader() []byte {
+	header := make([]byte, segmentHeaderSize)
+	copy(header, segmentMagic)
+	binary.LittleEndian.PutUint32(header[len(segmentMagic):], segmentFormat)
+	return header
+}
+
+// errSealed is returned by writes to a block whose writer was stopped.
+var errSealed = fmt.Errorf("segment is sealed")
+
 type hashIndex map[string]int64
 
 type block struct {
 	index   hashIndex
 	segment *os.File
+	// reader is a read-only handle of the segment shared by all lookups.
+	reader *os.File
+	// filter rules out keys that are not in a sealed block. It is nil for
+	// the active block.
+	filter *bloomFilter
+	// maxVersion is the highest version of the records stored in the block.
+	maxVersion uint64
 
 	outPath   string
 	outOffset int64
 	mu        sync.RWMutex
 
-	writeCh  chan writeArgument
-	deleteCh chan deleteRequest
+	writeCh chan writeArgument
+
+	syncPolicy   SyncPolicy
+	syncInterval time.Duration
+	syncBytes    int64
 
 	cancel context.CancelFunc
+	done   chan struct{}
 }
 
-func newBlock(dir string, outFileName string) (*block, error) {
+// newBlock opens a segment file and builds its index. The index of a sealed
+// block is loaded from the hint file when there is a valid one, and its bloom
+// filter is loaded too. opts may be nil, in which case writes are never synced
+// explicitly.
+func newBlock(dir string, outFileName string, sealed bool, opts *Options) (*block, error) {
 	outputPath := filepath.Join(dir, outFileName)
 	f, err := os.OpenFile(outputPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
 	if err != nil {
 		return nil, err
 	}
+	reader, err := os.Open(outputPath)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
 	bl := &block{
 		index:   make(hashIndex),
 		segment: f,
+		reader:  reader,
 
-		outPath:  outputPath,
-		writeCh:  make(chan writeArgument),
-		deleteCh: make(chan deleteRequest),
+		outPath: outputPath,
+		writeCh: make(chan writeArgument),
+		done:    make(chan struct{}),
+	}
+	if opts != nil {
+		bl.syncPolicy = opts.Sync
+		bl.syncInterval = opts.SyncInterval
+		bl.syncBytes = opts.SyncBytes
+	}
+	if bl.syncInterval <= 0 {
+		bl.syncInterval = DefaultSyncInterval
+	}
+	err = bl.initHeader()
+	if err != nil {
+		f.Close()
+		reader.Close()
+		return nil, err
+	}
+	if !sealed || !bl.loadHint() {
+		err = bl.recover()
+		if err != nil && err != io.EOF {
+			f.Close()
+			reader.Close()
+			return nil, err
+		}
+	}
+	if sealed {
+		bl.loadFilter()
+		// Sealed segments are never written, so they don't need a writer.
+		bl.cancel = func() {}
+		close(bl.done)
+		return bl, nil
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 	bl.cancel = cancel
 	go bl.write(ctx)
-	err = bl.recover()
-	if err != nil && err != io.EOF {
+	return bl, nil
+}
+
+// seal stops the writer of the block once its pending writes are acknowledged.
+// The block can't be written after that.
+func (b *block) seal() {
+	b.cancel()
+	<-b.done
+}
+
+// truncateBlock cuts the segment file at offset, dropping a torn tail, and opens it again.
+func truncateBlock(dir string, outFileName string, offset int64, opts *Options) (*block, error) {
+	outputPath := filepath.Join(dir, outFileName)
+	info, err := os.Stat(outputPath)
+	if err != nil {
 		return nil, err
 	}
-	return bl, nil
+	err = os.Truncate(outputPath, offset)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Truncated segment %s at offset %d: dropped %d bytes", outFileName, offset, info.Size()-offset)
+	return newBlock(dir, outFileName, false, opts)
+}
+
+// initHeader writes the header of a new segment or checks the header of an
+// existing one. A header cut short by a crash is written again, as there
+// can't be any records after it.
+func (b *block) initHeader() error {
+	info, err := b.segment.Stat()
+	if err != nil {
+		return err
+	}
+	header := segmentHeader()
+	if info.Size() < segmentHeaderSize {
+		data := make([]byte, info.Size())
+		_, err = b.reader.ReadAt(data, 0)
+		if err != nil {
+			return err
+		}
+		if !bytes.HasPrefix(header, data) {
+			return &ErrSegmentFormat{Segment: filepath.Base(b.outPath)}
+		}
+		err = b.segment.Truncate(0)
+		if err == nil {
+			_, err = b.segment.Write(header)
+		}
+		if err == nil {
+			err = b.segment.Sync()
+		}
+		if err != nil {
+			return err
+		}
+	} else {
+		data := make([]byte, segmentHeaderSize)
+		_, err = b.reader.ReadAt(data, 0)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(data, header) {
+			formatErr := &ErrSegmentFormat{Segment: filepath.Base(b.outPath)}
+			if string(data[:len(segmentMagic)]) == segmentMagic {
+				formatErr.Version = binary.LittleEndian.Uint32(data[len(segmentMagic):])
+			}
+			return formatErr
+		}
+	}
+	b.outOffset = segmentHeaderSize
+	return nil
 }
 
 const bufSize = 8192
@@ -62,120 +232,163 @@ func (b *block) recover() error {
 	}
 	defer input.Close()
 
+	info, err := input.Stat()
+	if err != nil {
+		return err
+	}
+	fileSize := info.Size()
+	_, err = input.Seek(b.outOffset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
 	var buf [bufSize]byte
 	in := bufio.NewReaderSize(input, bufSize)
-	for err == nil {
-		var (
-			header, data []byte
-			n            int
-		)
-		header, err = in.Peek(bufSize)
-		if err == io.EOF {
-			if len(header) == 0 {
-				return err
-			}
+	for {
+		header, err := in.Peek(4)
+		if err == io.EOF && len(header) == 0 {
+			return io.EOF
+		} else if err == io.EOF {
+			return b.corrupted(true)
 		} else if err != nil {
 			return err
 		}
-		size := binary.LittleEndian.Uint32(header)
+		size := int64(binary.LittleEndian.Uint32(header))
+		if size > fileSize-b.outOffset {
+			return b.corrupted(true)
+		}
+		last := b.outOffset+size == fileSize
 
+		var data []byte
 		if size < bufSize {
 			data = buf[:size]
 		} else {
 			data = make([]byte, size)
 		}
-		n, err = in.Read(data)
+		_, err = io.ReadFull(in, data)
+		if err != nil {
+			return err
+		}
+		if verifyRecord(data) != nil {
+			return b.corrupted(last)
+		}
 
-		if err == nil {
-			if n != int(size) {
-				return fmt.Errorf("corrupted file")
+		var e entry
+		e.Decode(data)
+		if e.vType == BATCH_TYPE {
+			err = batchRecords(data, func(pos int64, nested *entry) {
+				b.index[nested.key] = b.outOffset + pos
+				b.maxVersion = max(b.maxVersion, nested.version)
+			})
+			if err != nil {
+				return b.corrupted(last)
 			}
-
-			var e entry
-			e.Decode(data)
+		} else {
 			b.index[e.key] = b.outOffset
-			b.outOffset += int64(n)
+			b.maxVersion = max(b.maxVersion, e.version)
 		}
+		b.outOffset += size
 	}
-	return err
+}
+
+// corrupted reports a broken record at the current end of the recovered data.
+// tail tells that the record runs to the end of the file.
+func (b *block) corrupted(tail bool) error {
+	return &ErrCorruptRecord{Segment: filepath.Base(b.outPath), Offset: b.outOffset, tail: tail}
 }
 
 func (b *block) close() error {
 	b.cancel()
-	close(b.writeCh)
-	close(b.deleteCh)
-	return b.segment.Close()
+	<-b.done
+	return errors.Join(b.segment.Close(), b.reader.Close())
 }
-func (b *block) get(key string) (string, string, error) {
+
+// get reads the record of the key with positional reads of the shared handle,
+// so concurrent lookups don't need their own file descriptors.
+func (b *block) get(key string) (output, error) {
 	b.mu.RLock()
+	if b.filter != nil && !b.filter.mayContain(key) {
+		b.mu.RUnlock()
+		return output{}, ErrNotFound
+	}
 	position, ok := b.index[key]
+	end := b.outOffset
 	b.mu.RUnlock()
 	if !ok {
-		return "", "", ErrNotFound
+		return output{}, ErrNotFound
 	}
 
-	file, err := os.Open(b.outPath)
-	if err != nil {
-		return "", "", err
-	}
-	defer file.Close()
-
-	_, err = file.Seek(position, 0)
-	if err != nil {
-		return "", "", err
-	}
-
-	reader := bufio.NewReader(file)
+	reader := bufio.NewReader(io.NewSectionReader(b.reader, position, end-position))
 	pair, err := readValue(reader)
-	if err != nil {
-		return "", "", err
+	if err == errChecksum || errors.Is(err, io.ErrUnexpectedEOF) {
+		return output{}, &ErrCorruptRecord{Segment: filepath.Base(b.outPath), Offset: position}
+	} else if err != nil {
+		return output{}, err
 	}
 
-	return pair.value, pair.vType, nil
+	return pair, nil
 }
 
-func (b *block) put(key, vType, value string) error {
-	e := entry{
-		key:   key,
-		vType: ToByte(vType),
-		value: value,
-	}
-
-	resultCh := make(chan writeResult)
-	b.writeCh <- writeArgument{resultCh, e.Encode()}
-	result := <-resultCh
-	close(resultCh)
+// writeEntry appends the entry to the segment and points the index at it once
+// the write is acknowledged according to the block sync policy.
+func (b *block) writeEntry(e *entry) error {
+	return b.writeRecord(e, e.Encode())
+}
 
+// writeRecord is writeEntry for an entry that is already encoded into data.
+func (b *block) writeRecord(e *entry, data []byte) error {
+	result := b.append(data)
 	if result.err == nil {
 		b.mu.Lock()
-		b.index[key] = b.outOffset
-		b.outOffset += int64(result.n)
+		b.setIndex(e.key, result.offset)
+		b.setEnd(result)
+		b.maxVersion = max(b.maxVersion, e.version)
 		b.mu.Unlock()
 	}
-
 	return result.err
 }
 
-func (b *block) delete(key string) error {
-	e := entry{
-		key:   key,
-		vType: ToByte("delete"),
-		value: "",
+// writeBatch appends an encoded batch frame, so recovery sees either all of
+// its records or none.
+func (b *block) writeBatch(frame []byte) error {
+	result := b.append(frame)
+	if result.err != nil {
+		return result.err
 	}
 
-	resultCh := make(chan writeResult)
-	b.deleteCh <- deleteRequest{resultCh, e.Encode()}
-	result := <-resultCh
-	close(resultCh)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.setEnd(result)
+	return batchRecords(frame, func(pos int64, e *entry) {
+		b.setIndex(e.key, result.offset+pos)
+		b.maxVersion = max(b.maxVersion, e.version)
+	})
+}
 
-	if result.err == nil {
-		b.mu.Lock()
-		b.index[key] = b.outOffset
-		b.outOffset += int64(result.n)
-		b.mu.Unlock()
+func (b *block) append(data []byte) writeResult {
+	resultCh := make(chan writeResult, 1)
+	select {
+	case b.writeCh <- writeArgument{resultCh, data}:
+	case <-b.done:
+		return writeResult{err: errSealed}
+	}
+	return <-resultCh
+}
+
+// setIndex points the key at the record written at offset, unless a newer
+// record of the key was acknowledged first. It must be called with b.mu locked.
+func (b *block) setIndex(key string, offset int64) {
+	if prev, ok := b.index[key]; !ok || prev < offset {
+		b.index[key] = offset
 	}
+}
 
-	return result.err
+// setEnd moves the end of the block data past the written record. It must be
+// called with b.mu locked.
+func (b *block) setEnd(result writeResult) {
+	if end := result.offset + int64(result.n); end > b.outOffset {
+		b.outOffset = end
+	}
 }
 
 type writeArgument struct {
@@ -183,27 +396,87 @@ type writeArgument struct {
 	data     []byte
 }
 
-type deleteRequest struct {
-	resultCh chan writeResult
-	data     []byte
+type writeResult struct {
+	offset int64
+	n      int
+	err    error
 }
 
-type writeResult struct {
-	n   int
-	err error
+type pendingWrite struct {
+	resultCh chan writeResult
+	result   writeResult
 }
 
+// write is the only goroutine appending to the segment file. Depending on the
+// sync policy it acknowledges every write immediately, or collects written
+// records and acknowledges all of them after a single fsync.
 func (b *block) write(ctx context.Context) {
+	defer close(b.done)
+
+	offset := b.outOffset
+	var (
+		pending      []pendingWrite
+		pendingBytes int64
+		tick         <-chan time.Time
+	)
+	if b.syncPolicy == SyncBatch {
+		ticker := time.NewTicker(b.syncInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+		err := b.segment.Sync()
+		for _, p := range pending {
+			if err != nil {
+				p.result.err = err
+			}
+			p.resultCh <- p.result
+		}
+		pending = pending[:0]
+		pendingBytes = 0
+	}
+	appendData := func(arg writeArgument) {
+		n, err := b.segment.Write(arg.data)
+		result := writeResult{offset, n, err}
+		offset += int64(n)
+		if err != nil || b.syncPolicy == SyncNone {
+			arg.resultCh <- result
+			return
+		}
+		pending = append(pending, pendingWrite{arg.resultCh, result})
+		pendingBytes += int64(n)
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
+			flush()
 			return
 		case arg := <-b.writeCh:
-			n, err := b.segment.Write(arg.data)
-			arg.resultCh <- writeResult{n, err}
-		case req := <-b.deleteCh:
-			n, err := b.segment.Write(req.data)
-			req.resultCh <- writeResult{n, err}
+			appendData(arg)
+			switch b.syncPolicy {
+			case SyncAlways:
+				// Writers that queued up while we were busy share the same fsync.
+				for drained := false; !drained; {
+					select {
+					case arg := <-b.writeCh:
+						appendData(arg)
+					default:
+						drained = true
+					}
+				}
+				flush()
+			case SyncBatch:
+				if b.syncBytes > 0 && pendingBytes >= b.syncBytes {
+					flush()
+				}
+			}
+		case <-tick:
+			flush()
 		}
 	}
 }
@@ -217,40 +490,77 @@ func (b *block) size() (int64, error) {
 	return currentSize, nil
 }
 
+// mergeSuffix is appended to the name of the oldest merged segment to get the
+// file a merge is written to before it replaces the segment.
+const mergeSuffix = "-temp"
+
+// mergeAll writes the newest live record of every key from blocks into a new
+// block. Keys whose newest record is a tombstone or has expired are dropped completely.
 func mergeAll(blocks []*block) (*block, error) {
 	if len(blocks) == 0 {
 		return nil, fmt.Errorf("empty array of blocks")
 	}
-	newBlock, err := newBlock(blocks[0].outPath+"-temp", "")
+	tempPath := blocks[0].outPath + mergeSuffix
+	// A merge that crashed leaves its file behind. Its records are stale, so
+	// the merge must not append to them.
+	err := os.Remove(tempPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	newBlock, err := newBlock(tempPath, "", false, nil)
 	if err != nil {
 		return nil, err
 	}
+	seen := make(map[string]struct{})
+	now := time.Now()
 	for j := len(blocks) - 1; j >= 0; j = j - 1 {
-		err = mergePair(newBlock, blocks[j])
+		err = mergePair(newBlock, blocks[j], seen, now)
 		if err != nil {
+			newBlock.close()
+			os.Remove(newBlock.outPath)
 			return nil, err
 		}
 	}
 	return newBlock, nil
 }
-func mergePair(destBlock, srcBlock *block) error {
+
+func mergePair(destBlock, srcBlock *block, seen map[string]struct{}, now time.Time) error {
 	for key := range srcBlock.index {
-		_, ok := destBlock.index[key]
+		_, ok := seen[key]
 		if !ok {
-			val, vType, err := srcBlock.get(key)
+			seen[key] = struct{}{}
+			pair, err := srcBlock.get(key)
+			if err != nil {
+				return err
+			}
+			if pair.vType == "delete" || pair.expired(now) {
+				continue
+			}
+			err = destBlock.writeEntry(&entry{
+				key:       key,
+				vType:     ToByte(pair.vType),
+				value:     pair.value,
+				version:   pair.version,
+				expiresAt: pair.expiresAt,
+			})
 			if err != nil {
 				return err
 			}
-			destBlock.put(key, vType, val)
 		}
 	}
 	return nil
 }
 
 func (b *block) deleteblock() error {
-	err := os.Remove(b.segment.Name())
+	err := os.Remove(b.outPath)
 	if err != nil {
 		return err
 	}
+	for _, suffix := range []string{hintSuffix, bloomSuffix} {
+		err = os.Remove(b.outPath + suffix)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
 	return nil
 }
@@ -0,0 +1,70 @@
+package datastore
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"testing"
+)
+
+const benchKeys = 1000
+
+func benchmarkBlock(b *testing.B) *block {
+	bl, err := newBlock(b.TempDir(), outFile+"1", false, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { bl.close() })
+	for i := 0; i < benchKeys; i++ {
+		err := bl.writeEntry(&entry{key: "key" + strconv.Itoa(i), vType: ToByte("string"), value: "value" + strconv.Itoa(i)})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	return bl
+}
+
+// getOpenSeek is the way block.get used to read records: a new file handle
+// for every lookup.
+func getOpenSeek(b *block, key string) (output, error) {
+	b.mu.RLock()
+	position, ok := b.index[key]
+	b.mu.RUnlock()
+	if !ok {
+		return output{}, ErrNotFound
+	}
+	file, err := os.Open(b.outPath)
+	if err != nil {
+		return output{}, err
+	}
+	defer file.Close()
+	_, err = file.Seek(position, 0)
+	if err != nil {
+		return output{}, err
+	}
+	return readValue(bufio.NewReader(file))
+}
+
+func benchmarkGet(b *testing.B, get func(*block, string) (output, error)) {
+	bl := benchmarkBlock(b)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			key := "key" + strconv.Itoa(i%benchKeys)
+			if _, err := get(bl, key); err != nil {
+				b.Error(err)
+				return
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkBlockGet_ReadAt(b *testing.B) {
+	benchmarkGet(b, (*block).get)
+}
+
+func BenchmarkBlockGet_OpenSeek(b *testing.B) {
+	benchmarkGet(b, getOpenSeek)
+}
@@ -0,0 +1,138 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"hash/fnv"
+	"log"
+	"math"
+	"os"
+)
+
+// bloomSuffix is appended to a segment file name to get the name of its bloom
+// filter file. The file holds the number of hash functions, the number of keys
+// in the segment, the filter bits and a CRC32 checksum of the whole content.
+const bloomSuffix = ".bloom"
+
+// bloomFalsePositive is the target false positive rate of segment filters.
+const bloomFalsePositive = 0.01
+
+const bloomHeaderSize = 12
+
+// bloomFilter tells that a key is definitely not in a sealed segment.
+type bloomFilter struct {
+	k    uint32
+	keys int
+	bits []uint64
+}
+
+func newBloomFilter(keys int) *bloomFilter {
+	n := float64(max(keys, 1))
+	m := math.Ceil(-n * math.Log(bloomFalsePositive) / (math.Ln2 * math.Ln2))
+	k := math.Round(m / n * math.Ln2)
+	return &bloomFilter{
+		k:    uint32(max(k, 1)),
+		keys: keys,
+		bits: make([]uint64, (int(m)+63)/64),
+	}
+}
+
+// bloomHashes returns the two hashes that generate all bit positions of the key.
+func bloomHashes(key string) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	return sum, sum>>32 | sum<<32 | 1
+}
+
+func (f *bloomFilter) add(key string) {
+	h1, h2 := bloomHashes(key)
+	m := uint64(len(f.bits) * 64)
+	for i := uint64(0); i < uint64(f.k); i++ {
+		bit := (h1 + i*h2) % m
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+func (f *bloomFilter) mayContain(key string) bool {
+	h1, h2 := bloomHashes(key)
+	m := uint64(len(f.bits) * 64)
+	for i := uint64(0); i < uint64(f.k); i++ {
+		bit := (h1 + i*h2) % m
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// buildFilter creates the bloom filter of a sealed block from its index and
+// saves it next to the segment. The filter is used for lookups even if it
+// can't be saved.
+func (b *block) buildFilter() {
+	b.mu.Lock()
+	f := newBloomFilter(len(b.index))
+	for key := range b.index {
+		f.add(key)
+	}
+	b.filter = f
+	b.mu.Unlock()
+
+	err := f.write(b.outPath)
+	if err != nil {
+		log.Printf("Cannot write bloom filter for %s: %s", b.outPath, err)
+	}
+}
+
+// write saves the filter of the segment at segmentPath.
+func (f *bloomFilter) write(segmentPath string) error {
+	data := make([]byte, bloomHeaderSize, bloomHeaderSize+len(f.bits)*8+CHECKSUM_SIZE)
+	binary.LittleEndian.PutUint32(data, f.k)
+	binary.LittleEndian.PutUint64(data[4:], uint64(f.keys))
+	for _, word := range f.bits {
+		data = binary.LittleEndian.AppendUint64(data, word)
+	}
+	data = binary.LittleEndian.AppendUint32(data, crc32.ChecksumIEEE(data))
+
+	tempPath := segmentPath + "-temp" + bloomSuffix
+	err := os.WriteFile(tempPath, data, 0o600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempPath, segmentPath+bloomSuffix)
+}
+
+// loadFilter reads the bloom filter of the block. A missing, damaged or stale
+// filter is built again from the index.
+func (b *block) loadFilter() {
+	path := b.outPath + bloomSuffix
+	data, err := os.ReadFile(path)
+	if err == nil {
+		f, ok := readBloomFilter(data)
+		if ok && f.keys == len(b.index) {
+			b.filter = f
+			return
+		}
+		log.Printf("Ignoring damaged bloom filter %s", path)
+	}
+	b.buildFilter()
+}
+
+func readBloomFilter(data []byte) (*bloomFilter, bool) {
+	sumOffset := len(data) - CHECKSUM_SIZE
+	if sumOffset <= bloomHeaderSize || (sumOffset-bloomHeaderSize)%8 != 0 {
+		return nil, false
+	}
+	if binary.LittleEndian.Uint32(data[sumOffset:]) != crc32.ChecksumIEEE(data[:sumOffset]) {
+		return nil, false
+	}
+	f := &bloomFilter{
+		k:    binary.LittleEndian.Uint32(data),
+		keys: int(binary.LittleEndian.Uint64(data[4:])),
+		bits: make([]uint64, (sumOffset-bloomHeaderSize)/8),
+	}
+	for i := range f.bits {
+		f.bits[i] = binary.LittleEndian.Uint64(data[bloomHeaderSize+i*8:])
+	}
+	return f, true
+}
@@ -0,0 +1,90 @@
+package datastore
+
+import (
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	f := newBloomFilter(1000)
+	for i := 0; i < 1000; i++ {
+		f.add("key" + strconv.Itoa(i))
+	}
+	for i := 0; i < 1000; i++ {
+		if !f.mayContain("key" + strconv.Itoa(i)) {
+			t.Fatalf("False negative for key%d", i)
+		}
+	}
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if f.mayContain("missing" + strconv.Itoa(i)) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 300 {
+		t.Errorf("Too many false positives: %d of 10000", falsePositives)
+	}
+
+	data, err := os.CreateTemp(t.TempDir(), "segment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data.Close()
+	if err := f.write(data.Name()); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := os.ReadFile(data.Name() + bloomSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, ok := readBloomFilter(saved)
+	if !ok || loaded.k != f.k || loaded.keys != 1000 || len(loaded.bits) != len(f.bits) {
+		t.Fatalf("Cannot read saved filter")
+	}
+	saved[len(saved)/2] ^= 0xff
+	if _, ok := readBloomFilter(saved); ok {
+		t.Error("Damaged filter was loaded")
+	}
+}
+
+func TestDb_BloomFilters(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDb(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.compaction.stop()
+	db.segmentSize = 100
+	for i := 0; i < 10; i++ {
+		if err := db.Put("key"+strconv.Itoa(i), "value"+strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sealed := db.blocks[0]
+	if sealed.filter == nil || db.blocks[len(db.blocks)-1].filter != nil {
+		t.Fatal("Only sealed blocks must have a bloom filter")
+	}
+	if _, err := os.Stat(sealed.outPath + bloomSuffix); err != nil {
+		t.Fatalf("Bloom filter file is missing: %s", err)
+	}
+	db.Close()
+
+	if err := os.WriteFile(sealed.outPath+bloomSuffix, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDb(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 10; i++ {
+		value, err := db.Get("key" + strconv.Itoa(i))
+		if err != nil || value != "value"+strconv.Itoa(i) {
+			t.Errorf("Bad value for key%d: %s, %v", i, value, err)
+		}
+	}
+	if _, err := db.Get("missing"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,156 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func (db *Db) PutBytes(key string, value []byte) error {
+	defer db.lockKeys(key)()
+	_, err := db.putType(key, "bytes", string(value), 0)
+	return err
+}
+
+func (db *Db) GetBytes(key string) ([]byte, error) {
+	pair, err := db.getType(key)
+	if err != nil {
+		return nil, err
+	}
+	if pair.vType == "delete" {
+		return nil, ErrNotFound
+	}
+	if pair.vType != "bytes" {
+		return nil, ErrWrongType
+	}
+	return []byte(pair.value), nil
+}
+
+// ValueReader streams a string or bytes value straight from the segment file.
+// The record checksum is verified when the end of the value is reached.
+type ValueReader struct {
+	file    *os.File
+	value   *io.SectionReader
+	hash    hash.Hash32
+	sumAt   int64
+	vType   string
+	version uint64
+
+	segment string
+	offset  int64
+}
+
+// OpenValue returns a reader of the value of the key without loading it into
+// memory. The reader must be closed by the caller.
+func (db *Db) OpenValue(key string) (*ValueReader, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	for j := len(db.blocks) - 1; j >= 0; j = j - 1 {
+		b := db.blocks[j]
+		b.mu.RLock()
+		position, ok := b.index[key]
+		b.mu.RUnlock()
+		if !ok {
+			continue
+		}
+		return openValue(b.outPath, position)
+	}
+	return nil, ErrNotFound
+}
+
+func openValue(path string, position int64) (*ValueReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := newValueReader(file, position)
+	if err != nil {
+		file.Close()
+		if err == errChecksum || err == io.ErrUnexpectedEOF || err == io.EOF {
+			return nil, &ErrCorruptRecord{Segment: filepath.Base(path), Offset: position}
+		}
+		return nil, err
+	}
+	return r, nil
+}
+
+func newValueReader(file *os.File, position int64) (*ValueReader, error) {
+	var sizes [8]byte
+	_, err := file.ReadAt(sizes[:], position)
+	if err != nil {
+		return nil, err
+	}
+	size := int64(binary.LittleEndian.Uint32(sizes[:]))
+	kl := int64(binary.LittleEndian.Uint32(sizes[4:]))
+	headerSize := int64(payloadOffset(int(kl))) + 4
+	if size < headerSize+CHECKSUM_SIZE {
+		return nil, errChecksum
+	}
+
+	header := make([]byte, headerSize)
+	_, err = file.ReadAt(header, position)
+	if err != nil {
+		return nil, err
+	}
+	vType := ToType(header[kl+8])
+	expiresAt := int64(binary.LittleEndian.Uint64(header[kl+8+TYPE_SIZE+VERSION_SIZE:]))
+	if vType == "delete" || (expiresAt != 0 && time.Now().UnixNano() >= expiresAt) {
+		return nil, ErrNotFound
+	}
+	if vType != "string" && vType != "bytes" {
+		return nil, ErrWrongType
+	}
+	vl := int64(binary.LittleEndian.Uint32(header[headerSize-4:]))
+	if headerSize+vl+CHECKSUM_SIZE != size {
+		return nil, errChecksum
+	}
+
+	h := crc32.NewIEEE()
+	h.Write(header)
+	return &ValueReader{
+		file:    file,
+		value:   io.NewSectionReader(file, position+headerSize, vl),
+		hash:    h,
+		sumAt:   position + headerSize + vl,
+		vType:   vType,
+		version: binary.LittleEndian.Uint64(header[kl+8+TYPE_SIZE:]),
+		segment: filepath.Base(file.Name()),
+		offset:  position,
+	}, nil
+}
+
+func (r *ValueReader) Read(p []byte) (int, error) {
+	n, err := r.value.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF {
+		var sum [CHECKSUM_SIZE]byte
+		_, sumErr := r.file.ReadAt(sum[:], r.sumAt)
+		if sumErr != nil || binary.LittleEndian.Uint32(sum[:]) != r.hash.Sum32() {
+			return n, &ErrCorruptRecord{Segment: r.segment, Offset: r.offset}
+		}
+	}
+	return n, err
+}
+
+// Size returns the length of the value in bytes.
+func (r *ValueReader) Size() int64 {
+	return r.value.Size()
+}
+
+// Type returns the type of the value: "string" or "bytes".
+func (r *ValueReader) Type() string {
+	return r.vType
+}
+
+func (r *ValueReader) Version() uint64 {
+	return r.version
+}
+
+func (r *ValueReader) Close() error {
+	return r.file.Close()
+}
@@ -0,0 +1,95 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDb_BytesValues(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-bytes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	blob := make([]byte, 3<<20)
+	rand.New(rand.NewSource(1)).Read(blob)
+	blob[0], blob[1] = 0, 0
+	if err := db.PutBytes("blob", blob); err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := db.GetBytes("blob")
+	if err != nil || !bytes.Equal(value, blob) {
+		t.Fatalf("Bad blob value returned: %v", err)
+	}
+	if _, err := db.Get("blob"); err != ErrWrongType {
+		t.Errorf("Expected ErrWrongType for string read of bytes, got %v", err)
+	}
+
+	r, err := db.OpenValue("blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Size() != int64(len(blob)) || r.Type() != "bytes" {
+		t.Errorf("Unexpected value reader metadata: %d %s", r.Size(), r.Type())
+	}
+	streamed, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(streamed, blob) {
+		t.Fatalf("Bad streamed value: %v", err)
+	}
+
+	if _, err := db.OpenValue("missing"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestDb_StreamCorruptValue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-bytes-corrupt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.PutBytes("blob", bytes.Repeat([]byte{1, 2, 3}, 1000)); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, outFile+"1"), os.O_WRONLY, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{0xff}, 1000); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	r, err := db.OpenValue("blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	_, err = io.ReadAll(r)
+	var corrupt *ErrCorruptRecord
+	if !errors.As(err, &corrupt) {
+		t.Errorf("Expected ErrCorruptRecord while streaming, got %v", err)
+	}
+}
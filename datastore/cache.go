@@ -0,0 +1,131 @@
+package datastore
+
+import (
+	"container/list"
+	"sync"
+)
+
+// cacheEntryOverhead approximates the memory used by a cache entry besides
+// its key and value.
+const cacheEntryOverhead = 64
+
+// CacheStats describes the value cache of a Db.
+type CacheStats struct {
+	Hits    uint64
+	Misses  uint64
+	Entries int
+	Bytes   int64
+}
+
+// valueCache is an LRU cache of the newest records of keys, bounded by the
+// approximate size of the cached data. A zero-size cache is disabled.
+type valueCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	lru      *list.List
+	items    map[string]*list.Element
+	stats    CacheStats
+	// gen changes on every invalidation. A value read from disk is only
+	// cached if no key was invalidated while it was being read, so a reader
+	// racing with a writer can't put an old value back.
+	gen uint64
+}
+
+type cacheItem struct {
+	key  string
+	pair output
+}
+
+func (c *valueCache) init(maxBytes int64) {
+	c.maxBytes = maxBytes
+	c.lru = list.New()
+	c.items = make(map[string]*list.Element)
+}
+
+func itemSize(key string, pair output) int64 {
+	return int64(len(key)+len(pair.value)) + cacheEntryOverhead
+}
+
+// get returns the cached record of the key. On a miss it returns the
+// generation to pass to add once the record is read from disk.
+func (c *valueCache) get(key string) (output, uint64, bool) {
+	if c.maxBytes <= 0 {
+		return output{}, 0, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		c.stats.Misses++
+		return output{}, c.gen, false
+	}
+	c.stats.Hits++
+	c.lru.MoveToFront(el)
+	return el.Value.(*cacheItem).pair, 0, true
+}
+
+func (c *valueCache) add(key string, pair output, gen uint64) {
+	size := itemSize(key, pair)
+	if c.maxBytes <= 0 || size > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen {
+		return
+	}
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+	c.items[key] = c.lru.PushFront(&cacheItem{key, pair})
+	c.stats.Entries++
+	c.stats.Bytes += size
+	for c.stats.Bytes > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove drops the element from the cache. It must be called with c.mu locked.
+func (c *valueCache) remove(el *list.Element) {
+	item := c.lru.Remove(el).(*cacheItem)
+	delete(c.items, item.key)
+	c.stats.Entries--
+	c.stats.Bytes -= itemSize(item.key, item.pair)
+}
+
+// invalidate drops the cached records of the keys. It has to be called after
+// the new records are indexed.
+func (c *valueCache) invalidate(keys ...string) {
+	if c.maxBytes <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	for _, key := range keys {
+		if el, ok := c.items[key]; ok {
+			c.remove(el)
+		}
+	}
+}
+
+// purge drops all cached records.
+func (c *valueCache) purge() {
+	if c.maxBytes <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	c.lru.Init()
+	c.items = make(map[string]*list.Element)
+	c.stats.Entries = 0
+	c.stats.Bytes = 0
+}
+
+// CacheStats returns the hit and miss counters and the current size of the value cache.
+func (db *Db) CacheStats() CacheStats {
+	db.cache.mu.Lock()
+	defer db.cache.mu.Unlock()
+	return db.cache.stats
+}
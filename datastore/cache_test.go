@@ -0,0 +1,89 @@
+package datastore
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestDb_Cache(t *testing.T) {
+	db, err := NewDb(t.TempDir(), &Options{CacheSize: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("key", "value1"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if value, err := db.Get("key"); err != nil || value != "value1" {
+			t.Fatalf("Bad value %s, %v", value, err)
+		}
+	}
+	if stats := db.CacheStats(); stats.Hits != 2 || stats.Misses != 1 || stats.Entries != 1 {
+		t.Errorf("Unexpected cache stats %+v", stats)
+	}
+
+	if err := db.Put("key", "value2"); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := db.Get("key"); value != "value2" {
+		t.Errorf("Cache returned a stale value %s", value)
+	}
+	if err := db.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get("key"); err != ErrNotFound {
+		t.Errorf("Cache returned a deleted key: %v", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		key := "key" + strconv.Itoa(i)
+		if err := db.Put(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Get(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := db.CacheStats(); stats.Bytes > 1000 || stats.Entries >= 100 {
+		t.Errorf("Cache grew over its limit: %+v", stats)
+	}
+}
+
+func TestDb_CacheConcurrentWrites(t *testing.T) {
+	db, err := NewDb(t.TempDir(), &Options{CacheSize: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					db.Get("key")
+				}
+			}
+		}()
+	}
+	for i := 0; i < 200; i++ {
+		value := strconv.Itoa(i)
+		if err := db.Put("key", value); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := db.Get("key"); err != nil || got != value {
+			t.Fatalf("Read %s after writing %s: %v", got, value, err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
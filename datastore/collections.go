@@ -0,0 +1,300 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// Lists, hashes and sets are stored as a sequence of items: list elements,
+// field/value pairs ordered by field, or members in sorted order. Every item
+// is encoded as its length followed by its bytes.
+
+func encodeItems(items []string) string {
+	size := 4
+	for _, item := range items {
+		size += 4 + len(item)
+	}
+	res := make([]byte, 4, size)
+	binary.LittleEndian.PutUint32(res, uint32(len(items)))
+	for _, item := range items {
+		res = binary.LittleEndian.AppendUint32(res, uint32(len(item)))
+		res = append(res, item...)
+	}
+	return string(res)
+}
+
+func decodeItems(value string) ([]string, error) {
+	if len(value) < 4 {
+		return nil, fmt.Errorf("bad collection value")
+	}
+	count := int(binary.LittleEndian.Uint32([]byte(value[:4])))
+	items := make([]string, 0, min(count, len(value)/4))
+	pos := 4
+	for i := 0; i < count; i++ {
+		if pos+4 > len(value) {
+			return nil, fmt.Errorf("bad collection value")
+		}
+		l := int(binary.LittleEndian.Uint32([]byte(value[pos : pos+4])))
+		pos += 4
+		if pos+l > len(value) {
+			return nil, fmt.Errorf("bad collection value")
+		}
+		items = append(items, value[pos:pos+l])
+		pos += l
+	}
+	return items, nil
+}
+
+func wrongType(actual, expected string) error {
+	return fmt.Errorf("%w: key holds %s, expected %s", ErrWrongType, actual, expected)
+}
+
+// getItems returns the items of a collection of type vType.
+func (db *Db) getItems(key, vType string) ([]string, error) {
+	pair, err := db.getType(key)
+	if err != nil {
+		return nil, err
+	}
+	if pair.vType == "delete" {
+		return nil, ErrNotFound
+	}
+	if pair.vType != vType {
+		return nil, wrongType(pair.vType, vType)
+	}
+	return decodeItems(pair.value)
+}
+
+// updateItems changes the collection of type vType under the key lock. fn gets
+// the current items, nil for a missing key, and returns the new ones. The key
+// is deleted when no items are left. The expiry time of the key is kept.
+func (db *Db) updateItems(key, vType string, fn func(items []string) ([]string, error)) error {
+	defer db.lockKeys(key)()
+
+	var (
+		items     []string
+		expiresAt int64
+		exists    bool
+	)
+	pair, err := db.getType(key)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	if err == nil && pair.vType != "delete" {
+		if pair.vType != vType {
+			return wrongType(pair.vType, vType)
+		}
+		items, err = decodeItems(pair.value)
+		if err != nil {
+			return err
+		}
+		expiresAt = pair.expiresAt
+		exists = true
+	}
+
+	items, err = fn(items)
+	if err != nil {
+		return err
+	}
+	if len(items) == 0 {
+		if exists {
+			_, err = db.putType(key, "delete", "", 0)
+		}
+		return err
+	}
+	_, err = db.putType(key, vType, encodeItems(items), expiresAt)
+	return err
+}
+
+// putItems replaces the value of the key with a new collection.
+func (db *Db) putItems(key, vType string, items []string) error {
+	if len(items) == 0 {
+		return fmt.Errorf("can't save empty %s", vType)
+	}
+	defer db.lockKeys(key)()
+	_, err := db.putType(key, vType, encodeItems(items), 0)
+	return err
+}
+
+func (db *Db) GetList(key string) ([]string, error) {
+	return db.getItems(key, "list")
+}
+
+func (db *Db) PutList(key string, values []string) error {
+	return db.putItems(key, "list", values)
+}
+
+// ListPush adds values to the end of the list, or to its front if front is
+// set, and returns the new length of the list.
+func (db *Db) ListPush(key string, front bool, values ...string) (int, error) {
+	var length int
+	err := db.updateItems(key, "list", func(items []string) ([]string, error) {
+		if front {
+			pushed := make([]string, 0, len(items)+len(values))
+			for i := len(values) - 1; i >= 0; i-- {
+				pushed = append(pushed, values[i])
+			}
+			items = append(pushed, items...)
+		} else {
+			items = append(items, values...)
+		}
+		length = len(items)
+		return items, nil
+	})
+	return length, err
+}
+
+// ListPop removes and returns the last element of the list, or its first
+// element if front is set. An empty list is deleted.
+func (db *Db) ListPop(key string, front bool) (string, error) {
+	var value string
+	err := db.updateItems(key, "list", func(items []string) ([]string, error) {
+		if len(items) == 0 {
+			return nil, ErrNotFound
+		}
+		if front {
+			value, items = items[0], items[1:]
+		} else {
+			value, items = items[len(items)-1], items[:len(items)-1]
+		}
+		return items, nil
+	})
+	return value, err
+}
+
+func (db *Db) GetHash(key string) (map[string]string, error) {
+	items, err := db.getItems(key, "hash")
+	if err != nil {
+		return nil, err
+	}
+	return itemsToHash(items), nil
+}
+
+func (db *Db) PutHash(key string, fields map[string]string) error {
+	return db.putItems(key, "hash", hashToItems(fields))
+}
+
+// HashGet returns the value of a single field of the hash.
+func (db *Db) HashGet(key, field string) (string, error) {
+	fields, err := db.GetHash(key)
+	if err != nil {
+		return "", err
+	}
+	value, ok := fields[field]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return value, nil
+}
+
+func (db *Db) HashSet(key, field, value string) error {
+	return db.updateItems(key, "hash", func(items []string) ([]string, error) {
+		fields := itemsToHash(items)
+		fields[field] = value
+		return hashToItems(fields), nil
+	})
+}
+
+// HashDelete removes the field from the hash. An empty hash is deleted.
+func (db *Db) HashDelete(key, field string) error {
+	return db.updateItems(key, "hash", func(items []string) ([]string, error) {
+		fields := itemsToHash(items)
+		if _, ok := fields[field]; !ok {
+			return nil, ErrNotFound
+		}
+		delete(fields, field)
+		return hashToItems(fields), nil
+	})
+}
+
+func itemsToHash(items []string) map[string]string {
+	fields := make(map[string]string, len(items)/2)
+	for i := 0; i+1 < len(items); i += 2 {
+		fields[items[i]] = items[i+1]
+	}
+	return fields
+}
+
+func hashToItems(fields map[string]string) []string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	items := make([]string, 0, len(fields)*2)
+	for _, name := range names {
+		items = append(items, name, fields[name])
+	}
+	return items
+}
+
+// GetSet returns the members of the set in sorted order.
+func (db *Db) GetSet(key string) ([]string, error) {
+	return db.getItems(key, "set")
+}
+
+func (db *Db) PutSet(key string, members []string) error {
+	return db.putItems(key, "set", setToItems(itemsToSet(members)))
+}
+
+func (db *Db) SetIsMember(key, member string) (bool, error) {
+	members, err := db.GetSet(key)
+	if err == ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	i := sort.SearchStrings(members, member)
+	return i < len(members) && members[i] == member, nil
+}
+
+// SetAdd adds members to the set and returns how many of them were not there before.
+func (db *Db) SetAdd(key string, members ...string) (int, error) {
+	var added int
+	err := db.updateItems(key, "set", func(items []string) ([]string, error) {
+		set := itemsToSet(items)
+		for _, member := range members {
+			if _, ok := set[member]; !ok {
+				set[member] = struct{}{}
+				added++
+			}
+		}
+		return setToItems(set), nil
+	})
+	return added, err
+}
+
+// SetRemove removes members from the set and returns how many of them were
+// there. An empty set is deleted.
+func (db *Db) SetRemove(key string, members ...string) (int, error) {
+	var removed int
+	err := db.updateItems(key, "set", func(items []string) ([]string, error) {
+		set := itemsToSet(items)
+		for _, member := range members {
+			if _, ok := set[member]; ok {
+				delete(set, member)
+				removed++
+			}
+		}
+		return setToItems(set), nil
+	})
+	return removed, err
+}
+
+func itemsToSet(items []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(items))
+	for _, item := range items {
+		set[item] = struct{}{}
+	}
+	return set
+}
+
+func setToItems(set map[string]struct{}) []string {
+	items := make([]string, 0, len(set))
+	for member := range set {
+		items = append(items, member)
+	}
+	sort.Strings(items)
+	return items
+}
@@ -0,0 +1,133 @@
+package datastore
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestDb_List(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if n, err := db.ListPush("list", false, "b", "c"); err != nil || n != 2 {
+		t.Fatalf("Cannot push: %d, %v", n, err)
+	}
+	if n, err := db.ListPush("list", true, "a", "0"); err != nil || n != 4 {
+		t.Fatalf("Cannot push to front: %d, %v", n, err)
+	}
+	items, err := db.GetList("list")
+	if err != nil || !reflect.DeepEqual(items, []string{"0", "a", "b", "c"}) {
+		t.Errorf("Unexpected list %v, %v", items, err)
+	}
+
+	if value, err := db.ListPop("list", true); err != nil || value != "0" {
+		t.Errorf("Unexpected front pop %s, %v", value, err)
+	}
+	if value, err := db.ListPop("list", false); err != nil || value != "c" {
+		t.Errorf("Unexpected pop %s, %v", value, err)
+	}
+	db.ListPop("list", false)
+	db.ListPop("list", false)
+	if _, err := db.GetList("list"); err != ErrNotFound {
+		t.Errorf("Expected empty list to be deleted, got %v", err)
+	}
+	if _, err := db.ListPop("list", false); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for pop from missing list, got %v", err)
+	}
+
+	if err := db.Put("text", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ListPush("text", false, "x"); !errors.Is(err, ErrWrongType) {
+		t.Errorf("Expected ErrWrongType, got %v", err)
+	}
+}
+
+func TestDb_Hash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.HashSet("user", "name", "Alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.HashSet("user", "age", "30"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.HashGet("user", "name"); err != nil || value != "Alice" {
+		t.Errorf("Unexpected field value %s, %v", value, err)
+	}
+	if _, err := db.HashGet("user", "email"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for missing field, got %v", err)
+	}
+	if err := db.HashDelete("user", "age"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db, err = NewDb(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	fields, err := db.GetHash("user")
+	if err != nil || !reflect.DeepEqual(fields, map[string]string{"name": "Alice"}) {
+		t.Errorf("Unexpected hash after restart %v, %v", fields, err)
+	}
+	if _, err := db.GetSet("user"); !errors.Is(err, ErrWrongType) {
+		t.Errorf("Expected ErrWrongType, got %v", err)
+	}
+}
+
+func TestDb_Set(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-set")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if n, err := db.SetAdd("tags", "go", "db", "go"); err != nil || n != 2 {
+		t.Fatalf("Unexpected add result %d, %v", n, err)
+	}
+	if n, err := db.SetAdd("tags", "db", "http"); err != nil || n != 1 {
+		t.Fatalf("Unexpected add result %d, %v", n, err)
+	}
+	if ok, err := db.SetIsMember("tags", "http"); err != nil || !ok {
+		t.Errorf("Expected http to be a member: %v", err)
+	}
+	if n, err := db.SetRemove("tags", "http", "java"); err != nil || n != 1 {
+		t.Errorf("Unexpected remove result %d, %v", n, err)
+	}
+	members, err := db.GetSet("tags")
+	if err != nil || !reflect.DeepEqual(members, []string{"db", "go"}) {
+		t.Errorf("Unexpected set %v, %v", members, err)
+	}
+	if ok, err := db.SetIsMember("missing", "go"); err != nil || ok {
+		t.Errorf("Unexpected membership in missing set: %v", err)
+	}
+}
@@ -0,0 +1,181 @@
+package datastore
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// CompactionStatus describes the background merging of sealed segments.
+type CompactionStatus struct {
+	Running        bool
+	Runs           int
+	LastDuration   time.Duration
+	LastError      error
+	BytesReclaimed int64
+}
+
+// compactor merges sealed segments in a background goroutine, so that writers
+// are never blocked for the whole rewrite.
+type compactor struct {
+	triggerCh chan struct{}
+	cancel    context.CancelFunc
+	done      chan struct{}
+
+	// runMu makes sure only one merge runs at a time.
+	runMu sync.Mutex
+
+	statusMu sync.Mutex
+	status   CompactionStatus
+}
+
+func (c *compactor) start(db *Db) {
+	c.triggerCh = make(chan struct{}, 1)
+	c.done = make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	go func() {
+		defer close(c.done)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-c.triggerCh:
+				db.compact()
+			}
+		}
+	}()
+}
+
+func (c *compactor) stop() {
+	c.cancel()
+	<-c.done
+}
+
+// trigger asks for a compaction without waiting for it. Requests made while a
+// compaction is pending are coalesced.
+func (c *compactor) trigger() {
+	select {
+	case c.triggerCh <- struct{}{}:
+	default:
+	}
+}
+
+// CompactionStatus reports whether a compaction is running and how the last one went.
+func (db *Db) CompactionStatus() CompactionStatus {
+	db.compaction.statusMu.Lock()
+	defer db.compaction.statusMu.Unlock()
+	return db.compaction.status
+}
+
+// compact merges all sealed blocks into a single segment and swaps it into
+// the block list. The active block is never touched.
+func (db *Db) compact() error {
+	c := &db.compaction
+	c.runMu.Lock()
+	defer c.runMu.Unlock()
+
+	db.mu.RLock()
+	sealed := append([]*block(nil), db.blocks[:len(db.blocks)-1]...)
+	db.mu.RUnlock()
+	if len(sealed) < 2 {
+		return nil
+	}
+
+	c.statusMu.Lock()
+	c.status.Running = true
+	c.statusMu.Unlock()
+	start := time.Now()
+
+	reclaimed, err := db.mergeSealed(sealed)
+	if err != nil {
+		log.Printf("Compaction failed: %s", err)
+	}
+
+	c.statusMu.Lock()
+	c.status.Running = false
+	c.status.Runs++
+	c.status.LastDuration = time.Since(start)
+	c.status.LastError = err
+	c.status.BytesReclaimed += reclaimed
+	c.statusMu.Unlock()
+	return err
+}
+
+// mergeSealed writes the merged segment, replaces the sealed blocks with it
+// and removes their files. It returns the number of bytes freed on disk.
+func (db *Db) mergeSealed(sealed []*block) (int64, error) {
+	var sealedSize int64
+	for _, b := range sealed {
+		size, err := b.size()
+		if err != nil {
+			return 0, err
+		}
+		sealedSize += size
+	}
+
+	merged, err := mergeAll(sealed)
+	if err != nil {
+		return 0, err
+	}
+	merged.seal()
+	if db.opts.Sync != SyncNone {
+		err = merged.segment.Sync()
+		if err != nil {
+			merged.close()
+			os.Remove(merged.outPath)
+			return 0, err
+		}
+	}
+
+	db.mu.Lock()
+	mergedPath := filepath.Join(db.dir, db.segmentName+"0")
+	for _, suffix := range []string{hintSuffix, bloomSuffix} {
+		err = os.Remove(mergedPath + suffix)
+		if err != nil && !os.IsNotExist(err) {
+			break
+		}
+		err = nil
+	}
+	if err == nil {
+		err = os.Rename(merged.outPath, mergedPath)
+	}
+	if err != nil {
+		db.mu.Unlock()
+		merged.close()
+		os.Remove(merged.outPath)
+		return 0, err
+	}
+	merged.outPath = mergedPath
+	// Only compaction removes blocks, so the sealed ones are still the head of the list.
+	blocks := make([]*block, 0, len(db.blocks)-len(sealed)+1)
+	blocks = append(blocks, merged)
+	db.blocks = append(blocks, db.blocks[len(sealed):]...)
+	db.mu.Unlock()
+	db.cache.purge()
+
+	for _, b := range sealed {
+		b.close()
+		if b.outPath == mergedPath {
+			continue
+		}
+		err = b.deleteblock()
+		if err != nil {
+			return 0, err
+		}
+	}
+	err = merged.writeHint()
+	if err != nil {
+		log.Printf("Cannot write hint file for %s: %s", merged.outPath, err)
+	}
+	merged.buildFilter()
+
+	mergedSize, err := merged.size()
+	if err != nil {
+		return 0, err
+	}
+	return sealedSize - mergedSize, nil
+}
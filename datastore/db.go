@@ -1,12 +1,18 @@
 package datastore
 
 import (
+	"errors"
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -15,53 +21,175 @@ const (
 
 const OutfileSize int64 = 10000000
 
+// DefaultMergeThreshold is the number of sealed segments that triggers a
+// merge when Options.MergeThreshold is not set.
+const DefaultMergeThreshold = 2
+
+// RecoveryMode defines what NewDb does when the active segment ends with a broken record.
+type RecoveryMode int
+
+const (
+	// RecoverStrict refuses to open the database if any record is corrupt.
+	// It is the default.
+	RecoverStrict RecoveryMode = iota
+	// RecoverTruncate cuts off a torn tail of the active segment, that is a
+	// broken last record or one that runs past the end of the file, and
+	// opens the database. Broken records followed by other data are still
+	// reported as corrupt.
+	RecoverTruncate
+)
+
+// SyncPolicy defines when written records are flushed to stable storage.
+type SyncPolicy int
+
+const (
+	// SyncNone leaves flushing to the OS. It is the fastest policy, but an
+	// acknowledged write may be lost on power failure.
+	SyncNone SyncPolicy = iota
+	// SyncAlways acknowledges a write only after fsync. Writes that arrive
+	// while the previous fsync is running are acknowledged by a single fsync.
+	SyncAlways
+	// SyncBatch groups writes and acknowledges them after an fsync that runs
+	// every SyncInterval or as soon as SyncBytes are written.
+	SyncBatch
+)
+
+// DefaultSyncInterval is the group commit interval used by SyncBatch when Options.SyncInterval is not set.
+const DefaultSyncInterval = 10 * time.Millisecond
+
+// Options configures a Db. A nil *Options passed to NewDb means default options.
+type Options struct {
+	// SegmentSize is the size in bytes after which the active segment is
+	// sealed and a new one is started. OutfileSize is used when it's not set.
+	SegmentSize int64
+	// MergeThreshold is the number of sealed segments that makes the
+	// background compaction merge them. It can't be less than 2.
+	MergeThreshold int
+	// SegmentPrefix is the beginning of the segment file names, which end
+	// with the segment number. It is "segment-" when not set.
+	SegmentPrefix string
+
+	Recovery RecoveryMode
+
+	Sync         SyncPolicy
+	SyncInterval time.Duration
+	SyncBytes    int64
+
+	// FeedBytes limits the size of the recent records kept in memory for
+	// followers. DefaultFeedBytes is used when it's not set.
+	FeedBytes int64
+
+	// CacheSize is the approximate memory in bytes used to cache recently
+	// read values. Zero disables the cache.
+	CacheSize int64
+}
+
 type Db struct {
+	// mu guards the list of blocks. Writers hold it for reading while their
+	// record is appended, so a block can't be sealed or merged under them.
+	mu            sync.RWMutex
 	blocks        []*block
 	dir           string
 	segmentName   string
 	segmentNumber int
 	segmentSize   int64
+	// mergeThreshold is the number of sealed blocks that triggers compaction.
+	mergeThreshold int
+	opts           Options
+
+	// lock is the locked file that keeps other processes out of dir.
+	lock *os.File
+
+	compaction compactor
+	feed       changeFeed
+	cache      valueCache
+
+	// seq is the last version given to a record.
+	seq      atomic.Uint64
+	keyLocks [keyLockCount]sync.Mutex
 }
 
-func NewDb(dir string) (*Db, error) {
+func NewDb(dir string, opts *Options) (*Db, error) {
 	db := &Db{
-		dir:         dir,
-		segmentName: outFile,
-		segmentSize: OutfileSize,
+		dir:            dir,
+		segmentName:    outFile,
+		segmentSize:    OutfileSize,
+		mergeThreshold: DefaultMergeThreshold,
+	}
+	if opts != nil {
+		db.opts = *opts
+	}
+	err := db.applyOptions()
+	if err != nil {
+		return nil, err
 	}
 
 	if _, err := os.Stat(dir); os.IsNotExist(err) {
 		os.MkdirAll(dir, os.ModePerm)
 	}
-	f, err := os.Open(dir)
+	db.lock, err = lockDir(dir)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
-
-	filesNames, err := f.Readdirnames(0)
+	filesNames, err := readDirNames(dir)
+	if err == nil {
+		err = db.recover(filesNames)
+	}
 	if err != nil {
+		for _, b := range db.blocks {
+			b.close()
+		}
+		unlockFile(db.lock)
 		return nil, err
 	}
 
-	if len(filesNames) != 0 {
-		err := db.recover(filesNames)
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		err = db.addNewBlockToDb()
-		if err != nil {
-			return nil, err
+	for _, b := range db.blocks {
+		if b.maxVersion > db.seq.Load() {
+			db.seq.Store(b.maxVersion)
 		}
 	}
-
+	db.feed.init(db.opts.FeedBytes)
+	db.cache.init(db.opts.CacheSize)
+	db.compaction.start(db)
 	return db, nil
 }
 
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdirnames(0)
+}
+
+// applyOptions checks the layout options and overrides the defaults with them.
+func (db *Db) applyOptions() error {
+	opts := &db.opts
+	if opts.SegmentSize < 0 {
+		return fmt.Errorf("segment size must not be negative, got %d", opts.SegmentSize)
+	}
+	if opts.SegmentSize > 0 {
+		db.segmentSize = opts.SegmentSize
+	}
+	if opts.MergeThreshold != 0 && opts.MergeThreshold < 2 {
+		return fmt.Errorf("merge threshold must be at least 2, got %d", opts.MergeThreshold)
+	}
+	if opts.MergeThreshold != 0 {
+		db.mergeThreshold = opts.MergeThreshold
+	}
+	if strings.ContainsAny(opts.SegmentPrefix, `/\`) {
+		return fmt.Errorf("segment prefix must not contain path separators: %q", opts.SegmentPrefix)
+	}
+	if opts.SegmentPrefix != "" {
+		db.segmentName = opts.SegmentPrefix
+	}
+	return nil
+}
+
 func (db *Db) addNewBlockToDb() error {
 	db.segmentNumber++
-	b, err := newBlock(db.dir, db.segmentName+strconv.Itoa((db.segmentNumber)))
+	b, err := newBlock(db.dir, db.segmentName+strconv.Itoa((db.segmentNumber)), false, &db.opts)
 	if err != nil {
 		return err
 	}
@@ -69,138 +197,223 @@ func (db *Db) addNewBlockToDb() error {
 	return nil
 }
 
+// recover opens the segments found among filesNames in the order of their
+// numbers. Files that are not segments are ignored.
 func (db *Db) recover(filesNames []string) error {
-	sort.Strings(filesNames)
-	r, _ := regexp.Compile(db.segmentName + "[0-9]+")
+	r := segmentPattern(db.segmentName)
+	var segments []string
 	for _, fileName := range filesNames {
-		match := r.MatchString(fileName)
-
-		if match {
-			b, err := newBlock(db.dir, fileName)
-			if err != nil {
-				return err
-			}
-			db.blocks = append(db.blocks, b)
-			reg, _ := regexp.Compile("[0-9]+")
-			db.segmentNumber, err = strconv.Atoi(reg.FindString(fileName))
+		if fileName == lockFileName || strings.HasSuffix(fileName, hintSuffix) || strings.HasSuffix(fileName, bloomSuffix) {
+			continue
+		}
+		if strings.HasSuffix(fileName, mergeSuffix) && r.MatchString(strings.TrimSuffix(fileName, mergeSuffix)) {
+			// A compaction didn't finish, the segments it merged are still there.
+			log.Printf("Removing unfinished merge file %s in %s", fileName, db.dir)
+			err := os.Remove(filepath.Join(db.dir, fileName))
 			if err != nil {
 				return err
 			}
-		} else {
-			return fmt.Errorf("wrongly named file in the working directory: %v. Current file neme pattern: %v + int number", fileName, db.segmentName)
+			continue
+		}
+		if !r.MatchString(fileName) {
+			log.Printf("Ignoring unknown file %s in %s: segment files are named %s + number", fileName, db.dir, db.segmentName)
+			continue
 		}
+		segments = append(segments, fileName)
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return db.segmentIndex(segments[i]) < db.segmentIndex(segments[j])
+	})
+
+	for i, fileName := range segments {
+		active := i == len(segments)-1
+		b, err := newBlock(db.dir, fileName, !active, &db.opts)
+		var corrupt *ErrCorruptRecord
+		if errors.As(err, &corrupt) && corrupt.tail && active && db.opts.Recovery == RecoverTruncate {
+			b, err = truncateBlock(db.dir, fileName, corrupt.Offset, &db.opts)
+		}
+		if err != nil {
+			return err
+		}
+		db.blocks = append(db.blocks, b)
+		db.segmentNumber = db.segmentIndex(fileName)
+	}
+	if len(db.blocks) == 0 {
+		return db.addNewBlockToDb()
 	}
 	return nil
 }
 
+// segmentIndex returns the number of the segment file that matches the segment pattern.
+func (db *Db) segmentIndex(fileName string) int {
+	n, _ := strconv.Atoi(strings.TrimPrefix(fileName, db.segmentName))
+	return n
+}
+
+// segmentPattern matches the names of segment files with the prefix.
+func segmentPattern(prefix string) *regexp.Regexp {
+	return regexp.MustCompile("^" + regexp.QuoteMeta(prefix) + "[0-9]+$")
+}
+
 func (db *Db) Close() error {
+	db.compaction.stop()
+	db.mu.Lock()
+	defer db.mu.Unlock()
 	for _, block := range db.blocks {
 		block.close()
 	}
-	return nil
+	return unlockFile(db.lock)
 }
 
-func (db *Db) getType(key string) (string, string, error) {
-	var val, vType string
-	var err error
-	for j := len(db.blocks) - 1; j >= 0; j = j - 1 {
-		val, vType, err = db.blocks[j].get(key)
-		if err != nil && err != ErrNotFound {
-			return "", "", err
-		}
-		if vType == "delete" {
-			return "", "delete", nil
+// getType returns the newest record of the key. Expired records are reported as missing.
+func (db *Db) getType(key string) (output, error) {
+	pair, gen, ok := db.cache.get(key)
+	if !ok {
+		var err error
+		pair, err = db.readType(key)
+		if err != nil {
+			return output{}, err
 		}
-		if val != "" {
-			return val, vType, nil
+		db.cache.add(key, pair, gen)
+	}
+	if pair.expired(time.Now()) {
+		return output{}, ErrNotFound
+	}
+	return pair, nil
+}
+
+// readType reads the newest record of the key from the segment files.
+func (db *Db) readType(key string) (output, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	for j := len(db.blocks) - 1; j >= 0; j = j - 1 {
+		pair, err := db.blocks[j].get(key)
+		if err == ErrNotFound {
+			continue
 		}
+		return pair, err
 	}
-	return "", "", err
+	return output{}, ErrNotFound
 }
 
-func (db *Db) putType(key, vType, value string) error {
-	actBlock := db.blocks[len(db.blocks)-1]
-	curSize, err := actBlock.size()
+// putType writes a record with the next version and returns the version. A
+// zero expiresAt means that the record never expires. The caller must hold
+// the lock of the key.
+func (db *Db) putType(key, vType, value string, expiresAt int64) (uint64, error) {
+	e := entry{
+		key:       key,
+		vType:     ToByte(vType),
+		value:     value,
+		version:   db.nextVersion(),
+		expiresAt: expiresAt,
+	}
+	data := e.Encode()
+	err := db.writeActive(func(b *block) error {
+		return b.writeRecord(&e, data)
+	})
 	if err != nil {
-		return err
+		return 0, err
 	}
-	if curSize <= db.segmentSize {
-		err := actBlock.put(key, vType, value)
+	db.cache.invalidate(key)
+	db.feed.append(data)
+	return e.version, nil
+}
+
+// writeActive calls write with the active block, rotating it first if it has
+// grown over the segment size.
+func (db *Db) writeActive(write func(*block) error) error {
+	for {
+		db.mu.RLock()
+		actBlock := db.blocks[len(db.blocks)-1]
+		curSize, err := actBlock.size()
+		if err != nil {
+			db.mu.RUnlock()
+			return err
+		}
+		if curSize <= db.segmentSize {
+			err = write(actBlock)
+			db.mu.RUnlock()
+			return err
+		}
+		db.mu.RUnlock()
+
+		err = db.rotate(actBlock)
 		if err != nil {
 			return err
 		}
+	}
+}
+
+// rotate seals the full active block and starts a new segment. Nothing is done
+// if another writer has rotated the block already.
+func (db *Db) rotate(actBlock *block) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.blocks[len(db.blocks)-1] != actBlock {
 		return nil
 	}
 
-	err = db.addNewBlockToDb()
+	err := db.addNewBlockToDb()
 	if err != nil {
 		return err
 	}
-	err = db.blocks[len(db.blocks)-1].put(key, vType, value)
+	actBlock.seal()
+	err = actBlock.writeHint()
 	if err != nil {
-		return err
+		log.Printf("Cannot write hint file for %s: %s", actBlock.outPath, err)
 	}
-
-	if len(db.blocks) > 2 {
-		err = db.merge()
-		if err != nil {
-			return err
-		}
+	actBlock.buildFilter()
+	if len(db.blocks)-1 >= db.mergeThreshold {
+		db.compaction.trigger()
 	}
 	return nil
 }
 
 func (db *Db) Get(key string) (string, error) {
-	val, vType, err := db.getType(key)
+	pair, err := db.getType(key)
 	if err != nil {
 		return "", err
 	}
-	if vType == "delete" {
-		return "", fmt.Errorf("key not found")
+	if pair.vType == "delete" {
+		return "", ErrNotFound
 	}
-	if vType != "string" {
-		return "", fmt.Errorf("wrong type of value")
+	if pair.vType != "string" {
+		return "", ErrWrongType
 	}
-	return val, nil
+	return pair.value, nil
 }
 
 func (db *Db) Put(key, value string) error {
-	err := db.putType(key, "string", value)
+	defer db.lockKeys(key)()
+	_, err := db.putType(key, "string", value, 0)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (db *Db) Delete(key string) error {
-	err := db.putType(key, "delete", "")
-	if err != nil {
-		return err
+// PutWithTTL saves the value that is treated as missing once ttl passes.
+func (db *Db) PutWithTTL(key, value string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("ttl must be positive, got %s", ttl)
 	}
-	return nil
+	defer db.lockKeys(key)()
+	_, err := db.putType(key, "string", value, time.Now().Add(ttl).UnixNano())
+	return err
 }
 
-func (db *Db) merge() error {
-	tempBlock, err := mergeAll(db.blocks[:len(db.blocks)-1])
+// Delete removes the key of any type. It returns ErrNotFound if there is no
+// such key, in which case nothing is written.
+func (db *Db) Delete(key string) error {
+	defer db.lockKeys(key)()
+	version, err := db.currentVersion(key)
 	if err != nil {
 		return err
 	}
-
-	db.blocks = append(db.blocks[:1], db.blocks[:]...)
-	db.blocks[0] = tempBlock
-
-	for _, block := range db.blocks[1 : len(db.blocks)-1] {
-		err := block.deleteblock()
-		if err != nil {
-			return err
-		}
-	}
-
-	db.blocks = append(db.blocks[:1], db.blocks[len(db.blocks)-1])
-	err = os.Rename(tempBlock.segment.Name(), filepath.Join(db.dir, db.segmentName+"0"))
-	tempBlock.outPath = tempBlock.segment.Name()
-	if err != nil {
-		return err
+	if version == 0 {
+		return ErrNotFound
 	}
-	return nil
+	_, err = db.putType(key, "delete", "", 0)
+	return err
 }
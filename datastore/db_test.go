@@ -1,11 +1,16 @@
 package datastore
 
 import (
+	"bytes"
+	"errors"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strconv"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestDb_Put(t *testing.T) {
@@ -15,7 +20,7 @@ func TestDb_Put(t *testing.T) {
 	}
 	defer os.RemoveAll(dir)
 
-	db, err := NewDb(dir)
+	db, err := NewDb(dir, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -66,7 +71,7 @@ func TestDb_Put(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
-		if size1*2 != outInfo.Size() {
+		if (size1-segmentHeaderSize)*2+segmentHeaderSize != outInfo.Size() {
 			t.Errorf("Unexpected size (%d vs %d)", size1, outInfo.Size())
 		}
 	})
@@ -79,7 +84,7 @@ func TestDb_Delete(t *testing.T) {
 	}
 	defer os.RemoveAll(dir)
 
-	db, err := NewDb(dir)
+	db, err := NewDb(dir, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -121,4 +126,657 @@ func TestDb_Delete(t *testing.T) {
 			}
 		}
 	})
+
+	t.Run("delete missing", func(t *testing.T) {
+		for _, key := range []string{"key2", "unknown"} {
+			if err := db.Delete(key); err != ErrNotFound {
+				t.Errorf("Expected ErrNotFound when deleting %s, got %v", key, err)
+			}
+		}
+	})
+}
+
+func TestDb_CorruptRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-corrupt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key1", "value1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key2", "value2"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	segmentPath := filepath.Join(dir, outFile+"1")
+	data, err := os.ReadFile(segmentPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := entry{"key1", ToByte("string"), "value1", 1, 0}
+	firstSize := int64(len(first.Encode()))
+	data[len(data)-CHECKSUM_SIZE-1] ^= 0xff
+	if err := os.WriteFile(segmentPath, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewDb(dir, &Options{Recovery: RecoverStrict})
+	var corrupt *ErrCorruptRecord
+	if !errors.As(err, &corrupt) {
+		t.Fatalf("Expected ErrCorruptRecord, got %v", err)
+	}
+	if corrupt.Segment != outFile+"1" || corrupt.Offset != segmentHeaderSize+firstSize {
+		t.Errorf("Unexpected corruption position %s:%d", corrupt.Segment, corrupt.Offset)
+	}
+}
+
+func TestDb_TruncateTornTail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-truncate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key1", "value1"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	segmentPath := filepath.Join(dir, outFile+"1")
+	info, err := os.Stat(segmentPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	validSize := info.Size()
+
+	torn := entry{"key2", ToByte("string"), "value2", 1, 0}
+	data := torn.Encode()
+	f, err := os.OpenFile(segmentPath, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(data[:len(data)/2]); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	var corrupt *ErrCorruptRecord
+	if _, err := NewDb(dir, nil); !errors.As(err, &corrupt) {
+		t.Fatalf("Expected strict recovery by default, got %v", err)
+	}
+
+	db, err = NewDb(dir, &Options{Recovery: RecoverTruncate})
+	if err != nil {
+		t.Fatalf("Cannot open db with torn tail: %s", err)
+	}
+	defer db.Close()
+
+	value, err := db.Get("key1")
+	if err != nil || value != "value1" {
+		t.Errorf("Bad value after recovery: %s, %v", value, err)
+	}
+	info, err = os.Stat(segmentPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != validSize {
+		t.Errorf("Segment was not truncated: %d vs %d", info.Size(), validSize)
+	}
+	if err := db.Put("key2", "value2"); err != nil {
+		t.Fatal(err)
+	}
+	value, err = db.Get("key2")
+	if err != nil || value != "value2" {
+		t.Errorf("Bad value after write to recovered segment: %s, %v", value, err)
+	}
+}
+
+func TestDb_TruncateKeepsInnerCorruption(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDb(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"key1", "key2", "key3"} {
+		if err := db.Put(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	segmentPath := filepath.Join(dir, outFile+"1")
+	data, err := os.ReadFile(segmentPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A flipped bit in the first record must not drop the valid ones after it.
+	data[segmentHeaderSize+10] ^= 1
+	if err := os.WriteFile(segmentPath, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewDb(dir, &Options{Recovery: RecoverTruncate})
+	var corrupt *ErrCorruptRecord
+	if !errors.As(err, &corrupt) || corrupt.Offset != segmentHeaderSize {
+		t.Fatalf("Expected ErrCorruptRecord at the first record, got %v", err)
+	}
+	if after, _ := os.ReadFile(segmentPath); !bytes.Equal(after, data) {
+		t.Error("Segment with inner corruption was modified")
+	}
+}
+
+func TestDb_HintFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-hint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.segmentSize = 100
+	for i := 0; i < 10; i++ {
+		if err := db.Put("key"+strconv.Itoa(i), "value"+strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.compact(); err != nil {
+		t.Fatal(err)
+	}
+	sealed := db.blocks[0]
+	db.Close()
+
+	if _, err := os.Stat(sealed.outPath + hintSuffix); err != nil {
+		t.Fatalf("Hint file for sealed segment is missing: %s", err)
+	}
+	hinted := &block{index: make(hashIndex), outPath: sealed.outPath}
+	if !hinted.loadHint() {
+		t.Fatal("Cannot load hint file")
+	}
+	if !reflect.DeepEqual(hinted.index, sealed.index) || hinted.outOffset != sealed.outOffset {
+		t.Errorf("Hint index doesn't match the block index")
+	}
+
+	checkValues := func() {
+		db, err := NewDb(dir, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		for i := 0; i < 10; i++ {
+			value, err := db.Get("key" + strconv.Itoa(i))
+			if err != nil || value != "value"+strconv.Itoa(i) {
+				t.Errorf("Bad value for key%d: %s, %v", i, value, err)
+			}
+		}
+	}
+	checkValues()
+
+	if err := os.WriteFile(sealed.outPath+hintSuffix, []byte("garbage hint file"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if hinted.loadHint() {
+		t.Error("Damaged hint file was loaded")
+	}
+	checkValues()
+}
+
+func TestDb_SyncPolicy(t *testing.T) {
+	policies := map[string]Options{
+		"none":   {Sync: SyncNone},
+		"always": {Sync: SyncAlways},
+		"batch":  {Sync: SyncBatch, SyncInterval: 5 * time.Millisecond},
+		"bytes":  {Sync: SyncBatch, SyncInterval: 50 * time.Millisecond, SyncBytes: 64},
+	}
+	for name, opts := range policies {
+		opts := opts
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "test-db-sync")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			db, err := NewDb(dir, &opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var wg sync.WaitGroup
+			for i := 0; i < 50; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					if err := db.Put("key"+strconv.Itoa(i), "value"+strconv.Itoa(i)); err != nil {
+						t.Errorf("Cannot put key%d: %s", i, err)
+					}
+				}(i)
+			}
+			wg.Wait()
+			db.Close()
+
+			db, err = NewDb(dir, &opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			for i := 0; i < 50; i++ {
+				value, err := db.Get("key" + strconv.Itoa(i))
+				if err != nil || value != "value"+strconv.Itoa(i) {
+					t.Errorf("Bad value for key%d: %s, %v", i, value, err)
+				}
+			}
+		})
+	}
+}
+
+func TestDb_BackgroundCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-compaction")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.segmentSize = 200
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				key := "key" + strconv.Itoa(w*10+i%10)
+				if err := db.Put(key, "value"+strconv.Itoa(i)); err != nil {
+					t.Errorf("Cannot put %s: %s", key, err)
+				}
+			}
+		}(w)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				_, err := db.Get("key" + strconv.Itoa(w*10+i%10))
+				if err != nil && err != ErrNotFound {
+					t.Errorf("Cannot get key: %s", err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if err := db.compact(); err != nil {
+		t.Fatal(err)
+	}
+	status := db.CompactionStatus()
+	if status.Running || status.Runs == 0 || status.LastError != nil {
+		t.Errorf("Unexpected compaction status %+v", status)
+	}
+	if status.BytesReclaimed <= 0 {
+		t.Errorf("Compaction didn't reclaim any space: %+v", status)
+	}
+	for w := 0; w < 4; w++ {
+		for i := 90; i < 100; i++ {
+			key := "key" + strconv.Itoa(w*10+i%10)
+			value, err := db.Get(key)
+			if err != nil || value != "value"+strconv.Itoa(i) {
+				t.Errorf("Bad value for %s: %s, %v", key, value, err)
+			}
+		}
+	}
+}
+
+func TestDb_TombstonePurge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-tombstone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.segmentSize = 60
+
+	if err := db.Put("deleted", "old-value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("kept", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("filler1", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("deleted"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 2; i < 8; i++ {
+		if err := db.Put("filler"+strconv.Itoa(i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Get("deleted"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound before merge, got %v", err)
+	}
+	if err := db.compact(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := db.blocks[0].index["deleted"]; ok {
+		t.Error("Tombstone was copied to the merged segment")
+	}
+	if _, err := db.Get("deleted"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound after merge, got %v", err)
+	}
+	db.Close()
+
+	db, err = NewDb(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Get("deleted"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound after restart, got %v", err)
+	}
+	if value, err := db.Get("kept"); err != nil || value != "value" {
+		t.Errorf("Bad value for kept key: %s, %v", value, err)
+	}
+}
+
+func TestDb_PutWithTTL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-ttl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.segmentSize = 80
+
+	if err := db.PutWithTTL("session", "data", 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutWithTTL("long", "data", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get("session"); err != nil || value != "data" {
+		t.Errorf("Bad value before expiry: %s, %v", value, err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if _, err := db.Get("session"); err != ErrNotFound {
+		t.Errorf("Expected expired key to be missing, got %v", err)
+	}
+	keys, err := db.Scan("", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []string{"long"}) {
+		t.Errorf("Unexpected keys %v", keys)
+	}
+
+	for i := 0; i < 6; i++ {
+		if err := db.Put("filler"+strconv.Itoa(i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.compact(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := db.blocks[0].index["session"]; ok {
+		t.Error("Expired key was copied to the merged segment")
+	}
+	db.Close()
+
+	db, err = NewDb(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Get("session"); err != ErrNotFound {
+		t.Errorf("Expected expired key to be missing after restart, got %v", err)
+	}
+	if value, err := db.Get("long"); err != nil || value != "data" {
+		t.Errorf("Bad value for long living key: %s, %v", value, err)
+	}
+}
+
+func TestDb_Options(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-options")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := &Options{SegmentSize: 100, MergeThreshold: 4, SegmentPrefix: "data1-"}
+	db, err := NewDb(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.compaction.stop()
+	for i := 0; i < 20; i++ {
+		if err := db.Put("key"+strconv.Itoa(i), "value"+strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+		if triggered := len(db.compaction.triggerCh) == 1; triggered != (len(db.blocks)-1 >= 4) {
+			t.Fatalf("Compaction triggered: %t with %d sealed segments", triggered, len(db.blocks)-1)
+		}
+	}
+	if len(db.blocks) < 5 {
+		t.Errorf("Segment size option was ignored: %d blocks", len(db.blocks))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "data1-1")); err != nil {
+		t.Errorf("Segment prefix option was ignored: %s", err)
+	}
+	db.Close()
+
+	db, err = NewDb(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if value, err := db.Get("key9"); err != nil || value != "value9" {
+		t.Errorf("Bad value after reopening: %s, %v", value, err)
+	}
+
+	for _, bad := range []Options{{SegmentSize: -1}, {MergeThreshold: 1}, {SegmentPrefix: "a/b"}} {
+		if _, err := NewDb(t.TempDir(), &bad); err == nil {
+			t.Errorf("Expected options %+v to be rejected", bad)
+		}
+	}
+}
+
+func TestDb_Lock(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDb(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewDb(dir, nil); !errors.Is(err, ErrLocked) {
+		t.Errorf("Expected ErrLocked for the second open, got %v", err)
+	}
+	db.Close()
+
+	db, err = NewDb(dir, nil)
+	if err != nil {
+		t.Fatalf("Cannot open the directory after close: %s", err)
+	}
+	db.Close()
+}
+
+func TestDb_ForeignFiles(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDb(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.compaction.stop()
+	db.segmentSize = 10
+	// Every put goes to a new segment, so the key ends up in segment-1 ...
+	// segment-12 and only the last one has the newest value.
+	for i := 0; i < 12; i++ {
+		if err := db.Put("key", "value"+strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(db.blocks) < 10 {
+		t.Fatalf("Expected more than 10 segments, got %d", len(db.blocks))
+	}
+	db.Close()
+
+	for _, name := range []string{".DS_Store", "segment-3.bak", "notes.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("foreign"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db, err = NewDb(dir, nil)
+	if err != nil {
+		t.Fatalf("Foreign files were not ignored: %s", err)
+	}
+	defer db.Close()
+	if value, err := db.Get("key"); err != nil || value != "value11" {
+		t.Errorf("Segments were not sorted by number: got %s, %v", value, err)
+	}
+}
+
+func TestDb_SegmentFormat(t *testing.T) {
+	dir := t.TempDir()
+	segmentPath := filepath.Join(dir, outFile+"1")
+
+	// A segment of an older version has records right from the start.
+	legacy := []byte("\x1a\x00\x00\x00\x04\x00\x00\x00key1\x00\x06\x00\x00\x00value1")
+	if err := os.WriteFile(segmentPath, legacy, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := NewDb(dir, &Options{Recovery: RecoverTruncate})
+	var formatErr *ErrSegmentFormat
+	if !errors.As(err, &formatErr) || formatErr.Version != 0 {
+		t.Fatalf("Expected ErrSegmentFormat for a segment without header, got %v", err)
+	}
+	if data, _ := os.ReadFile(segmentPath); !bytes.Equal(data, legacy) {
+		t.Error("Legacy segment was modified")
+	}
+
+	future := segmentHeader()
+	future[len(segmentMagic)] = segmentFormat + 1
+	if err := os.WriteFile(segmentPath, future, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewDb(dir, nil)
+	if !errors.As(err, &formatErr) || formatErr.Version != segmentFormat+1 {
+		t.Fatalf("Expected ErrSegmentFormat for a newer format, got %v", err)
+	}
+
+	// A header cut short while the segment was created is written again.
+	if err := os.WriteFile(segmentPath, segmentHeader()[:3], 0o600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewDb(dir, nil)
+	if err != nil {
+		t.Fatalf("Cannot open db with a torn segment header: %s", err)
+	}
+	defer db.Close()
+	if err := db.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get("key"); err != nil || value != "value" {
+		t.Errorf("Bad value %s, %v", value, err)
+	}
+}
+
+func TestDb_SealStopsWriter(t *testing.T) {
+	db, err := NewDb(t.TempDir(), &Options{SegmentSize: 10, MergeThreshold: 100, Sync: SyncBatch})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 3; i++ {
+		if err := db.Put("key"+strconv.Itoa(i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db.mu.RLock()
+	blocks := append([]*block(nil), db.blocks...)
+	db.mu.RUnlock()
+	if len(blocks) < 3 {
+		t.Fatalf("Expected sealed segments, got %d blocks", len(blocks))
+	}
+	for _, b := range blocks[:len(blocks)-1] {
+		select {
+		case <-b.done:
+		default:
+			t.Errorf("Writer of sealed segment %s is still running", b.outPath)
+		}
+		if result := b.append([]byte("data")); result.err != errSealed {
+			t.Errorf("Expected errSealed writing to %s, got %v", b.outPath, result.err)
+		}
+	}
+}
+
+func TestDb_MergeLeftover(t *testing.T) {
+	dir := t.TempDir()
+	// writeLeftover leaves a merge file like a compaction that crashed.
+	writeLeftover := func(path string) {
+		t.Helper()
+		b, err := newBlock(path, "", false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.writeEntry(&entry{key: "ghost", vType: STRING_TYPE, value: "boo", version: 1}); err != nil {
+			t.Fatal(err)
+		}
+		b.close()
+	}
+
+	leftover := filepath.Join(dir, outFile+"1"+mergeSuffix)
+	writeLeftover(leftover)
+	db, err := NewDb(dir, &Options{SegmentSize: 60, MergeThreshold: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Errorf("Merge file left by a crash was not removed: %v", err)
+	}
+
+	for i := 0; i < 6; i++ {
+		if err := db.Put("key"+strconv.Itoa(i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.mu.RLock()
+	leftover = db.blocks[0].outPath + mergeSuffix
+	db.mu.RUnlock()
+	writeLeftover(leftover)
+	if err := db.compact(); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get("ghost"); err != ErrNotFound {
+		t.Errorf("Stale record of a crashed merge came back: %s, %v", value, err)
+	}
+	for i := 0; i < 6; i++ {
+		if value, err := db.Get("key" + strconv.Itoa(i)); err != nil || value != "value" {
+			t.Errorf("Bad value for key%d: %s, %v", i, value, err)
+		}
+	}
 }
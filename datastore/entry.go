@@ -4,74 +4,143 @@ import (
 	"bufio"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"time"
 )
 
 type entry struct {
-	key   string
-	vType byte
-	value string
+	key     string
+	vType   byte
+	value   string
+	version uint64
+	// expiresAt is the Unix time in nanoseconds after which the record is
+	// treated as missing. Zero means that the record never expires.
+	expiresAt int64
 }
 
 type typeOperator interface {
 	Encode(*entry) []byte
 	Decode([]byte, *entry)
-	Read(*bufio.Reader) (string, error)
+	// Read reads the value from the type specific data of a record, which is
+	// size bytes long. The record isn't verified yet, so Read must not trust
+	// lengths stored in it beyond size.
+	Read(in *bufio.Reader, size int64) (string, error)
+	// validPayload reports whether the type specific data of a record is
+	// well formed, so that Decode can't read past it.
+	validPayload([]byte) bool
 }
 
 type stringOperator struct{}
 
-func encodeKey(e *entry, vl int) ([]byte, int) {
+// encodeKey allocates a record with room for a payload of size pl and fills in
+// the common header: size, key, value type, version and expiry time. It returns the record
+// and the offset of the payload.
+func encodeKey(e *entry, pl int) ([]byte, int) {
 	kl := len(e.key)
-	size := kl + TYPE_SIZE + vl + 12
+	offset := payloadOffset(kl)
+	size := offset + pl + CHECKSUM_SIZE
 	res := make([]byte, size)
 	binary.LittleEndian.PutUint32(res, uint32(size))
 	binary.LittleEndian.PutUint32(res[4:], uint32(kl))
 	copy(res[8:], e.key)
-	return res, kl + 8
+	res[kl+8] = e.vType
+	binary.LittleEndian.PutUint64(res[kl+8+TYPE_SIZE:], e.version)
+	binary.LittleEndian.PutUint64(res[kl+8+TYPE_SIZE+VERSION_SIZE:], uint64(e.expiresAt))
+	return res, offset
+}
+
+// payloadOffset returns the offset of the type specific data in a record with a key of length kl.
+func payloadOffset(kl int) int {
+	return kl + 8 + TYPE_SIZE + VERSION_SIZE + EXPIRY_SIZE
 }
 
 func (s stringOperator) Encode(e *entry) []byte {
-	res, offset := encodeKey(e, len(e.value))
 	vl := len(e.value)
-	res[offset] = STRING_TYPE
-	binary.LittleEndian.PutUint32(res[offset+TYPE_SIZE:], uint32(vl))
-	copy(res[offset+TYPE_SIZE+4:], e.value)
+	res, offset := encodeKey(e, 4+vl)
+	binary.LittleEndian.PutUint32(res[offset:], uint32(vl))
+	copy(res[offset+4:], e.value)
 	return res
 }
 
 func (s stringOperator) Decode(input []byte, e *entry) {
-	kl := len(e.key)
-	vl := binary.LittleEndian.Uint32(input[kl+TYPE_SIZE+8:])
+	offset := payloadOffset(len(e.key))
+	vl := int(binary.LittleEndian.Uint32(input[offset:]))
 	valBuf := make([]byte, vl)
-	copy(valBuf, input[kl+TYPE_SIZE+12:kl+TYPE_SIZE+12+int(vl)])
+	copy(valBuf, input[offset+4:offset+4+vl])
 	e.value = string(valBuf)
 }
 
-func (s stringOperator) Read(in *bufio.Reader) (string, error) {
+func (s stringOperator) validPayload(payload []byte) bool {
+	return len(payload) >= 4 && int64(binary.LittleEndian.Uint32(payload)) == int64(len(payload)-4)
+}
+
+func (s stringOperator) Read(in *bufio.Reader, size int64) (string, error) {
 	header, err := in.Peek(4)
 	if err != nil {
 		return "", err
 	}
 	valSize := int(binary.LittleEndian.Uint32(header))
+	if int64(valSize) != size-4 {
+		return "", errChecksum
+	}
 	_, err = in.Discard(4)
 	if err != nil {
 		return "", err
 	}
 
 	data := make([]byte, valSize)
-	n, err := in.Read(data)
+	n, err := io.ReadFull(in, data)
 	if err != nil {
-		return "", err
-	}
-	if n != valSize {
-		return "", fmt.Errorf("can't read value bytes (read %d, expected %d)", n, valSize)
+		return "", fmt.Errorf("can't read value bytes (read %d, expected %d): %w", n, valSize, err)
 	}
 
 	return string(data), nil
 }
 
+// int64Operator stores the value as 8 little endian bytes. In memory the
+// value is kept as a decimal string.
+type int64Operator struct{}
+
+func (o int64Operator) Encode(e *entry) []byte {
+	n, _ := strconv.ParseInt(e.value, 10, 64)
+	res, offset := encodeKey(e, 8)
+	binary.LittleEndian.PutUint64(res[offset:], uint64(n))
+	return res
+}
+
+func (o int64Operator) Decode(input []byte, e *entry) {
+	offset := payloadOffset(len(e.key))
+	n := int64(binary.LittleEndian.Uint64(input[offset:]))
+	e.value = strconv.FormatInt(n, 10)
+}
+
+func (o int64Operator) validPayload(payload []byte) bool {
+	return len(payload) == 8
+}
+
+func (o int64Operator) Read(in *bufio.Reader, size int64) (string, error) {
+	if size != 8 {
+		return "", errChecksum
+	}
+	var data [8]byte
+	_, err := io.ReadFull(in, data[:])
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(int64(binary.LittleEndian.Uint64(data[:])), 10), nil
+}
+
 var typeToByte map[string]byte = map[string]byte{
 	"string": STRING_TYPE,
+	"delete": DELETE_TYPE,
+	"batch":  BATCH_TYPE,
+	"int64":  INT64_TYPE,
+	"bytes":  BYTES_TYPE,
+	"list":   LIST_TYPE,
+	"hash":   HASH_TYPE,
+	"set":    SET_TYPE,
 }
 
 func ToByte(vType string) byte {
@@ -89,16 +158,71 @@ func ToType(value byte) string {
 
 var operators map[byte]typeOperator = map[byte]typeOperator{
 	STRING_TYPE: stringOperator{},
+	// A tombstone is encoded like a string record with an empty value.
+	DELETE_TYPE: stringOperator{},
+	// A batch frame holds the encoded records of the batch as its value.
+	BATCH_TYPE: stringOperator{},
+	INT64_TYPE: int64Operator{},
+	// Byte values are stored the same way as strings, but may hold arbitrary binary data.
+	BYTES_TYPE: stringOperator{},
+	// Lists, hashes and sets keep their items encoded with encodeItems as a string value.
+	LIST_TYPE: stringOperator{},
+	HASH_TYPE: stringOperator{},
+	SET_TYPE:  stringOperator{},
 }
 
 const (
-	TYPE_SIZE        = 1
-	STRING_TYPE byte = 0
+	TYPE_SIZE          = 1
+	VERSION_SIZE       = 8
+	EXPIRY_SIZE        = 8
+	CHECKSUM_SIZE      = 4
+	STRING_TYPE   byte = 0
+	DELETE_TYPE   byte = 1
+	BATCH_TYPE    byte = 2
+	INT64_TYPE    byte = 3
+	BYTES_TYPE    byte = 4
+	LIST_TYPE     byte = 5
+	HASH_TYPE     byte = 6
+	SET_TYPE      byte = 7
 )
 
+// errChecksum is returned when the stored checksum of a record does not match its content.
+var errChecksum = fmt.Errorf("record checksum mismatch")
+
+// Encode serializes the entry and appends a CRC32 checksum of all the preceding record bytes.
 func (e *entry) Encode() []byte {
 	operator := operators[e.vType]
-	return operator.Encode(e)
+	res := operator.Encode(e)
+	sumOffset := len(res) - CHECKSUM_SIZE
+	binary.LittleEndian.PutUint32(res[sumOffset:], crc32.ChecksumIEEE(res[:sumOffset]))
+	return res
+}
+
+// verifyRecord checks that data is a whole record with a valid trailing
+// checksum, a known value type and a well formed payload. Only verified
+// records may be decoded.
+func verifyRecord(data []byte) error {
+	if len(data) < payloadOffset(0)+CHECKSUM_SIZE {
+		return errChecksum
+	}
+	if int(binary.LittleEndian.Uint32(data)) != len(data) {
+		return errChecksum
+	}
+	kl := int(binary.LittleEndian.Uint32(data[4:]))
+	if kl > len(data)-payloadOffset(0)-CHECKSUM_SIZE {
+		return errChecksum
+	}
+	sumOffset := len(data) - CHECKSUM_SIZE
+	if binary.LittleEndian.Uint32(data[sumOffset:]) != crc32.ChecksumIEEE(data[:sumOffset]) {
+		return errChecksum
+	}
+	// The checksum only proves that the bytes are the ones that were
+	// written, a record from the network may still be malformed.
+	operator, ok := operators[data[kl+8]]
+	if !ok || !operator.validPayload(data[payloadOffset(kl):sumOffset]) {
+		return errChecksum
+	}
+	return nil
 }
 
 func (e *entry) Decode(input []byte) {
@@ -108,40 +232,87 @@ func (e *entry) Decode(input []byte) {
 	e.key = string(keyBuf)
 
 	typeValue := input[kl+8]
+	e.vType = typeValue
+	e.version = binary.LittleEndian.Uint64(input[kl+8+TYPE_SIZE:])
+	e.expiresAt = int64(binary.LittleEndian.Uint64(input[kl+8+TYPE_SIZE+VERSION_SIZE:]))
 	operator := operators[typeValue]
 
 	operator.Decode(input, e)
 }
 
 type output struct {
-	vType string
-	value string
+	vType     string
+	value     string
+	version   uint64
+	expiresAt int64
+}
+
+// expired reports whether the record has an expiry time that has passed at now.
+func (o output) expired(now time.Time) bool {
+	return o.expiresAt != 0 && now.UnixNano() >= o.expiresAt
 }
 
+// readValue reads a single record from in and returns its value. The record
+// checksum is computed while reading and errChecksum is returned on mismatch.
 func readValue(in *bufio.Reader) (output, error) {
 	header, err := in.Peek(8)
 	if err != nil {
 		return output{}, err
 	}
+	size := int64(binary.LittleEndian.Uint32(header))
 	keySize := int(binary.LittleEndian.Uint32(header[4:]))
-	_, err = in.Discard(keySize + 8)
+	if size < int64(payloadOffset(keySize))+CHECKSUM_SIZE {
+		return output{}, errChecksum
+	}
+
+	hash := crc32.NewIEEE()
+	body := bufio.NewReader(io.TeeReader(io.LimitReader(in, size-CHECKSUM_SIZE), hash))
+
+	_, err = body.Discard(keySize + 8)
 	if err != nil {
 		return output{}, err
 	}
 
-	vType, err := in.Peek(1)
+	vType, err := body.Peek(1)
 	if err != nil {
 		return output{}, err
 	}
-	_, err = in.Discard(1)
+	typeValue := vType[0]
+	_, err = body.Discard(1)
+	if err != nil {
+		return output{}, err
+	}
+	var versionBuf [VERSION_SIZE + EXPIRY_SIZE]byte
+	_, err = io.ReadFull(body, versionBuf[:])
+	if err != nil {
+		return output{}, err
+	}
+
+	operator, ok := operators[typeValue]
+	if !ok {
+		return output{}, errChecksum
+	}
+	data, err := operator.Read(body, size-int64(payloadOffset(keySize))-CHECKSUM_SIZE)
+	if err != nil {
+		return output{}, err
+	}
+	_, err = io.Copy(io.Discard, body)
 	if err != nil {
 		return output{}, err
 	}
 
-	operator := operators[vType[0]]
-	data, err := operator.Read(in)
+	var sum [CHECKSUM_SIZE]byte
+	_, err = io.ReadFull(in, sum[:])
 	if err != nil {
 		return output{}, err
 	}
-	return output{ToType(vType[0]), data}, nil
+	if binary.LittleEndian.Uint32(sum[:]) != hash.Sum32() {
+		return output{}, errChecksum
+	}
+	return output{
+		vType:     ToType(typeValue),
+		value:     data,
+		version:   binary.LittleEndian.Uint64(versionBuf[:]),
+		expiresAt: int64(binary.LittleEndian.Uint64(versionBuf[VERSION_SIZE:])),
+	}, nil
 }
@@ -3,11 +3,13 @@ package datastore
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
+	"hash/crc32"
 	"testing"
 )
 
 func TestEntry_Encode(t *testing.T) {
-	e := entry{"key", ToByte("string"), "value"}
+	e := entry{"key", ToByte("string"), "value", 1, 0}
 	e.Decode(e.Encode())
 	if e.key != "key" {
 		t.Error("incorrect key")
@@ -15,19 +17,90 @@ func TestEntry_Encode(t *testing.T) {
 	if e.value != "value" {
 		t.Error("incorrect value")
 	}
+	if e.version != 1 {
+		t.Error("incorrect version")
+	}
 }
 
 func TestReadValue(t *testing.T) {
-	e := entry{"key", ToByte("string"), "test-value"}
+	e := entry{"key", ToByte("string"), "test-value", 1, 0}
 	data := e.Encode()
 	v, err := readValue(bufio.NewReader(bytes.NewReader(data)))
 	if err != nil {
 		t.Fatal(err)
 	}
 	if v.value != "test-value" {
-		t.Errorf("Got bad value [%s]", v)
+		t.Errorf("Got bad value [%v]", v)
 	}
 	if v.vType != "string" {
-		t.Errorf("Got bad value type [%s]", v)
+		t.Errorf("Got bad value type [%v]", v)
+	}
+}
+
+func TestReadValue_Checksum(t *testing.T) {
+	e := entry{"key", ToByte("string"), "test-value", 1, 0}
+	data := e.Encode()
+	data[len(data)-CHECKSUM_SIZE-1] ^= 0xff
+	_, err := readValue(bufio.NewReader(bytes.NewReader(data)))
+	if err != errChecksum {
+		t.Errorf("Expected checksum error, got %v", err)
+	}
+	if verifyRecord(data) != errChecksum {
+		t.Error("Corrupted record passed verification")
+	}
+}
+
+func TestReadValue_Length(t *testing.T) {
+	e := entry{"key", ToByte("string"), "test-value", 1, 0}
+	data := e.Encode()
+	// A flipped bit in the value length must not make the read allocate it.
+	binary.LittleEndian.PutUint32(data[payloadOffset(3):], 0xfffffff0)
+	_, err := readValue(bufio.NewReader(bytes.NewReader(data)))
+	if err != errChecksum {
+		t.Errorf("Expected checksum error, got %v", err)
+	}
+}
+
+func TestEntry_Tombstone(t *testing.T) {
+	if ToByte("delete") == ToByte("string") {
+		t.Fatal("Tombstones share the record type with strings")
+	}
+	e := entry{"key", ToByte("delete"), "", 1, 0}
+	v, err := readValue(bufio.NewReader(bytes.NewReader(e.Encode())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.vType != "delete" {
+		t.Errorf("Got bad value type [%s]", v.vType)
+	}
+}
+
+// resum replaces the checksum of a modified record with a valid one.
+func resum(data []byte) []byte {
+	sumOffset := len(data) - CHECKSUM_SIZE
+	binary.LittleEndian.PutUint32(data[sumOffset:], crc32.ChecksumIEEE(data[:sumOffset]))
+	return data
+}
+
+func TestVerifyRecord_Payload(t *testing.T) {
+	e := entry{"key", ToByte("string"), "value", 1, 0}
+	badLength := e.Encode()
+	binary.LittleEndian.PutUint32(badLength[payloadOffset(3):], 1000)
+	if verifyRecord(resum(badLength)) != errChecksum {
+		t.Error("Record with a bad value length passed verification")
+	}
+
+	unknownType := e.Encode()
+	unknownType[3+8] = 200
+	if verifyRecord(resum(unknownType)) != errChecksum {
+		t.Error("Record of an unknown type passed verification")
+	}
+
+	n := entry{"key", ToByte("int64"), "42", 1, 0}
+	shortInt := n.Encode()
+	shortInt = append(shortInt[:len(shortInt)-CHECKSUM_SIZE-1], 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(shortInt, uint32(len(shortInt)))
+	if verifyRecord(resum(shortInt)) != errChecksum {
+		t.Error("Short int64 record passed verification")
 	}
 }
@@ -0,0 +1,153 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultFeedBytes is the size of the change feed used when Options.FeedBytes is not set.
+const DefaultFeedBytes = 16 << 20
+
+// ErrFeedGone is returned when the requested change feed position was already
+// dropped from memory or belongs to an earlier run of the Db. The reader has
+// to start over from a backup.
+var ErrFeedGone = fmt.Errorf("change feed position is no longer available")
+
+// Position identifies a place in the change feed. Epoch is different for
+// every NewDb call and Index counts the records written since then.
+type Position struct {
+	Epoch uint64
+	Index uint64
+}
+
+// changeFeed keeps the most recent encoded records in the order they were
+// acknowledged, so that followers can replay them.
+type changeFeed struct {
+	mu      sync.Mutex
+	epoch   uint64
+	records [][]byte
+	// first is the index of records[0].
+	first    uint64
+	size     int64
+	maxBytes int64
+	// notify is closed and replaced when a record is appended.
+	notify chan struct{}
+}
+
+func (f *changeFeed) init(maxBytes int64) {
+	if maxBytes <= 0 {
+		maxBytes = DefaultFeedBytes
+	}
+	f.epoch = uint64(time.Now().UnixNano())
+	f.maxBytes = maxBytes
+	f.notify = make(chan struct{})
+}
+
+// append adds a record to the feed, dropping the oldest ones when the feed
+// grows over its limit. The newest record is always kept.
+func (f *changeFeed) append(data []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.records = append(f.records, data)
+	f.size += int64(len(data))
+	for f.size > f.maxBytes && len(f.records) > 1 {
+		f.size -= int64(len(f.records[0]))
+		f.records[0] = nil
+		f.records = f.records[1:]
+		f.first++
+	}
+	close(f.notify)
+	f.notify = make(chan struct{})
+}
+
+func (f *changeFeed) head() Position {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return Position{f.epoch, f.first + uint64(len(f.records))}
+}
+
+// read returns up to limit records starting at from, or a channel that is
+// closed when more records are available.
+func (f *changeFeed) read(from Position, limit int) ([][]byte, <-chan struct{}, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	end := f.first + uint64(len(f.records))
+	if from.Epoch != f.epoch || from.Index < f.first || from.Index > end {
+		return nil, nil, ErrFeedGone
+	}
+	if from.Index == end {
+		return nil, f.notify, nil
+	}
+	start := int(from.Index - f.first)
+	n := min(len(f.records)-start, limit)
+	return append([][]byte(nil), f.records[start:start+n]...), nil, nil
+}
+
+// FeedPosition returns the position of the next record written to the Db.
+func (db *Db) FeedPosition() Position {
+	return db.feed.head()
+}
+
+// ReadChanges returns up to limit encoded records written since from, waiting
+// for the first one if there are none yet. Every record is a whole segment
+// record that can be passed to ApplyRecord. The position after the returned
+// records is from.Index + len(records).
+func (db *Db) ReadChanges(ctx context.Context, from Position, limit int) ([][]byte, error) {
+	for {
+		records, wait, err := db.feed.read(from, limit)
+		if err != nil || len(records) > 0 {
+			return records, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-wait:
+		}
+	}
+}
+
+// ApplyRecord writes a record read from the change feed of another Db. The
+// record keeps its version, so a follower stays a copy of its leader.
+func (db *Db) ApplyRecord(data []byte) error {
+	err := verifyRecord(data)
+	if err != nil {
+		return fmt.Errorf("bad replicated record: %w", err)
+	}
+	var e entry
+	e.Decode(data)
+
+	keys := []string{e.key}
+	version := e.version
+	if e.vType == BATCH_TYPE {
+		keys = keys[:0]
+		err = batchRecords(data, func(_ int64, nested *entry) {
+			keys = append(keys, nested.key)
+			version = max(version, nested.version)
+		})
+		if err != nil {
+			return fmt.Errorf("bad replicated batch: %w", err)
+		}
+	}
+	defer db.lockKeys(keys...)()
+
+	for {
+		seq := db.seq.Load()
+		if seq >= version || db.seq.CompareAndSwap(seq, version) {
+			break
+		}
+	}
+	err = db.writeActive(func(b *block) error {
+		if e.vType == BATCH_TYPE {
+			return b.writeBatch(data)
+		}
+		return b.writeRecord(&e, data)
+	})
+	if err != nil {
+		return err
+	}
+	db.cache.invalidate(keys...)
+	db.feed.append(data)
+	return nil
+}
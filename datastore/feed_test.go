@@ -0,0 +1,112 @@
+package datastore
+
+import (
+	"context"
+	"encoding/binary"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDb_ApplyChanges(t *testing.T) {
+	leader, err := NewDb(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leader.Close()
+	follower, err := NewDb(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer follower.Close()
+
+	from := leader.FeedPosition()
+	if err := leader.Put("key1", "value1"); err != nil {
+		t.Fatal(err)
+	}
+	batch := leader.NewBatch()
+	batch.Put("key2", "value2")
+	batch.Delete("key1")
+	if err := batch.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	records, err := leader.ReadChanges(ctx, from, 10)
+	if err != nil || len(records) != 2 {
+		t.Fatalf("Unexpected changes: %d records, %v", len(records), err)
+	}
+	for _, data := range records {
+		if err := follower.ApplyRecord(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := follower.Get("key1"); err != ErrNotFound {
+		t.Errorf("Expected key1 to be deleted on follower, got %v", err)
+	}
+	_, leaderVersion, _ := leader.GetWithVersion("key2")
+	value, version, err := follower.GetWithVersion("key2")
+	if err != nil || value != "value2" || version != leaderVersion {
+		t.Errorf("Bad replicated key2: %s, version %d (leader %d), %v", value, version, leaderVersion, err)
+	}
+
+	// The feed has no more records, so the read waits until the deadline.
+	from.Index += uint64(len(records))
+	short, cancelShort := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancelShort()
+	if _, err := leader.ReadChanges(short, from, 10); err != context.DeadlineExceeded {
+		t.Errorf("Expected read to time out, got %v", err)
+	}
+	go leader.Put("key3", "value3")
+	if records, err := leader.ReadChanges(ctx, from, 10); err != nil || len(records) != 1 {
+		t.Errorf("Expected to be woken by a new record: %d records, %v", len(records), err)
+	}
+
+	if _, err := leader.ReadChanges(ctx, Position{from.Epoch + 1, 0}, 10); err != ErrFeedGone {
+		t.Errorf("Expected ErrFeedGone for another epoch, got %v", err)
+	}
+}
+
+func TestDb_FeedLimit(t *testing.T) {
+	db, err := NewDb(t.TempDir(), &Options{FeedBytes: 200})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	from := db.FeedPosition()
+	for i := 0; i < 20; i++ {
+		if err := db.Put("key"+strconv.Itoa(i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.ReadChanges(context.Background(), from, 10); err != ErrFeedGone {
+		t.Errorf("Expected dropped records to be gone, got %v", err)
+	}
+	head := db.FeedPosition()
+	if head.Index != from.Index+20 {
+		t.Errorf("Unexpected feed head %d", head.Index)
+	}
+	head.Index--
+	if records, err := db.ReadChanges(context.Background(), head, 10); err != nil || len(records) != 1 {
+		t.Errorf("Cannot read the newest record: %d records, %v", len(records), err)
+	}
+}
+
+func TestDb_ApplyMalformedRecord(t *testing.T) {
+	db, err := NewDb(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	e := entry{"key", ToByte("string"), "value", 1, 0}
+	data := e.Encode()
+	binary.LittleEndian.PutUint32(data[payloadOffset(3):], 1<<30)
+	if err := db.ApplyRecord(resum(data)); err == nil {
+		t.Error("Malformed record was applied")
+	}
+	if _, err := db.Get("key"); err != ErrNotFound {
+		t.Errorf("Expected no key after a rejected record, got %v", err)
+	}
+}
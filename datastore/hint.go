@@ -0,0 +1,89 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"log"
+	"os"
+)
+
+// hintSuffix is appended to a segment file name to get the name of its hint file.
+// A hint file holds the segment size and the highest record version followed
+// by key/offset pairs of the block index and a CRC32 checksum of the whole content.
+const hintSuffix = ".hint"
+
+const hintHeaderSize = 16
+
+// writeHint saves the block index next to the segment, so that recovery can
+// skip reading the whole segment file.
+func (b *block) writeHint() error {
+	b.mu.RLock()
+	data := make([]byte, hintHeaderSize, hintHeaderSize+len(b.index)*24)
+	binary.LittleEndian.PutUint64(data, uint64(b.outOffset))
+	binary.LittleEndian.PutUint64(data[8:], b.maxVersion)
+	for key, offset := range b.index {
+		data = binary.LittleEndian.AppendUint32(data, uint32(len(key)))
+		data = append(data, key...)
+		data = binary.LittleEndian.AppendUint64(data, uint64(offset))
+	}
+	b.mu.RUnlock()
+	data = binary.LittleEndian.AppendUint32(data, crc32.ChecksumIEEE(data))
+
+	tempPath := b.outPath + "-temp" + hintSuffix
+	err := os.WriteFile(tempPath, data, 0o600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempPath, b.outPath+hintSuffix)
+}
+
+// loadHint fills the block index from its hint file. It returns false if the
+// hint file is missing, damaged or doesn't match the segment, in which case
+// the segment has to be scanned.
+func (b *block) loadHint() bool {
+	hintPath := b.outPath + hintSuffix
+	data, err := os.ReadFile(hintPath)
+	if err != nil {
+		return false
+	}
+	if len(data) < hintHeaderSize+CHECKSUM_SIZE {
+		log.Printf("Ignoring truncated hint file %s", hintPath)
+		return false
+	}
+	sumOffset := len(data) - CHECKSUM_SIZE
+	if binary.LittleEndian.Uint32(data[sumOffset:]) != crc32.ChecksumIEEE(data[:sumOffset]) {
+		log.Printf("Ignoring hint file %s with bad checksum", hintPath)
+		return false
+	}
+
+	info, err := os.Stat(b.outPath)
+	if err != nil {
+		return false
+	}
+	size := int64(binary.LittleEndian.Uint64(data))
+	if size != info.Size() {
+		log.Printf("Ignoring stale hint file %s", hintPath)
+		return false
+	}
+
+	index := make(hashIndex)
+	for pos := hintHeaderSize; pos < sumOffset; {
+		if pos+4 > sumOffset {
+			return false
+		}
+		kl := int(binary.LittleEndian.Uint32(data[pos:]))
+		pos += 4
+		if pos+kl+8 > sumOffset {
+			return false
+		}
+		key := string(data[pos : pos+kl])
+		pos += kl
+		index[key] = int64(binary.LittleEndian.Uint64(data[pos:]))
+		pos += 8
+	}
+
+	b.index = index
+	b.outOffset = size
+	b.maxVersion = binary.LittleEndian.Uint64(data[8:])
+	return true
+}
@@ -0,0 +1,71 @@
+package datastore
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// ErrOverflow is returned by Incr when the result doesn't fit into int64.
+var ErrOverflow = fmt.Errorf("increment would overflow")
+
+func (db *Db) GetInt64(key string) (int64, error) {
+	pair, err := db.getType(key)
+	if err != nil {
+		return 0, err
+	}
+	if pair.vType == "delete" {
+		return 0, ErrNotFound
+	}
+	if pair.vType != "int64" {
+		return 0, ErrWrongType
+	}
+	return strconv.ParseInt(pair.value, 10, 64)
+}
+
+func (db *Db) PutInt64(key string, value int64) error {
+	defer db.lockKeys(key)()
+	_, err := db.putType(key, "int64", strconv.FormatInt(value, 10), 0)
+	return err
+}
+
+// Incr atomically adds delta to the int64 value of the key and returns the
+// result. A missing key is treated as 0. A string value holding a decimal
+// integer is incremented too and stays a string. The expiry time of the key
+// is kept.
+func (db *Db) Incr(key string, delta int64) (int64, error) {
+	defer db.lockKeys(key)()
+
+	var (
+		current   int64
+		expiresAt int64
+	)
+	vType := "int64"
+	pair, err := db.getType(key)
+	if err != nil && err != ErrNotFound {
+		return 0, err
+	}
+	if err == nil && pair.vType != "delete" {
+		if pair.vType != "int64" && pair.vType != "string" {
+			return 0, ErrWrongType
+		}
+		current, err = strconv.ParseInt(pair.value, 10, 64)
+		if err != nil && pair.vType == "string" {
+			return 0, ErrWrongType
+		} else if err != nil {
+			return 0, err
+		}
+		vType = pair.vType
+		expiresAt = pair.expiresAt
+	}
+
+	if (delta > 0 && current > math.MaxInt64-delta) || (delta < 0 && current < math.MinInt64-delta) {
+		return 0, ErrOverflow
+	}
+	current += delta
+	_, err = db.putType(key, vType, strconv.FormatInt(current, 10), expiresAt)
+	if err != nil {
+		return 0, err
+	}
+	return current, nil
+}
@@ -0,0 +1,78 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestDb_Incr(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-incr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := db.Incr("counter", 2); err != nil {
+				t.Errorf("Cannot increment: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	value, err := db.Incr("counter", -5)
+	if err != nil || value != 35 {
+		t.Errorf("Unexpected counter value %d, %v", value, err)
+	}
+
+	if err := db.Put("text", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Incr("text", 1); err != ErrWrongType {
+		t.Errorf("Expected ErrWrongType, got %v", err)
+	}
+	if err := db.Put("number", "10"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Incr("number", 5); err != nil || value != 15 {
+		t.Errorf("Unexpected increment of a numeric string: %d, %v", value, err)
+	}
+	if value, err := db.Get("number"); err != nil || value != "15" {
+		t.Errorf("Expected the numeric string to stay a string, got %s, %v", value, err)
+	}
+	if _, err := db.Get("counter"); err != ErrWrongType {
+		t.Errorf("Expected ErrWrongType for string read of int64, got %v", err)
+	}
+
+	if err := db.PutInt64("max", math.MaxInt64); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Incr("max", 1); err != ErrOverflow {
+		t.Errorf("Expected ErrOverflow, got %v", err)
+	}
+	db.Close()
+
+	db, err = NewDb(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if value, err := db.GetInt64("counter"); err != nil || value != 35 {
+		t.Errorf("Unexpected counter value after restart %d, %v", value, err)
+	}
+	if value, err := db.GetInt64("max"); err != nil || value != math.MaxInt64 {
+		t.Errorf("Unexpected max value after restart %d, %v", value, err)
+	}
+}
@@ -0,0 +1,159 @@
+package datastore
+
+import (
+	"container/heap"
+	"sort"
+	"strings"
+)
+
+// Iterator walks live keys of the Db in lexicographic order. Keys are listed
+// from the block indexes, values are read on every Next call, so keys deleted
+// in the meantime are skipped.
+type Iterator struct {
+	db     *Db
+	prefix string
+	// batch is the number of keys listed at a time, all of them if it's zero.
+	batch int
+	after string
+	keys  []string
+	pos   int
+	last  bool
+
+	key   string
+	value string
+	err   error
+}
+
+// Iterator returns an iterator over the keys that start with prefix and sort
+// after startAfter. An empty startAfter means iterating from the first key.
+// The set of keys is fixed when the iterator is created.
+func (db *Db) Iterator(prefix, startAfter string) *Iterator {
+	it := db.iterator(prefix, startAfter, 0)
+	it.list()
+	return it
+}
+
+func (db *Db) iterator(prefix, startAfter string, batch int) *Iterator {
+	return &Iterator{db: db, prefix: prefix, batch: batch, after: startAfter}
+}
+
+// list replaces the keys with the next batch of keys of the Db.
+func (it *Iterator) list() {
+	it.keys = it.db.keysAfter(it.prefix, it.after, it.batch)
+	it.pos = 0
+	it.last = it.batch <= 0 || len(it.keys) < it.batch
+	if len(it.keys) > 0 {
+		it.after = it.keys[len(it.keys)-1]
+	}
+}
+
+// keysAfter returns the first n keys of the block indexes that start with
+// prefix and sort after startAfter, or all of them if n isn't positive. Only
+// n keys are kept while the indexes are read, so a page of keys doesn't cost
+// sorting the whole key space.
+func (db *Db) keysAfter(prefix, startAfter string, n int) []string {
+	set := make(map[string]struct{})
+	var largest keyHeap
+	db.mu.RLock()
+	for _, b := range db.blocks {
+		b.mu.RLock()
+		for key := range b.index {
+			if !strings.HasPrefix(key, prefix) || key <= startAfter {
+				continue
+			}
+			if _, ok := set[key]; ok {
+				continue
+			}
+			if n > 0 && len(largest) == n {
+				if key > largest[0] {
+					continue
+				}
+				delete(set, heap.Pop(&largest).(string))
+			}
+			set[key] = struct{}{}
+			if n > 0 {
+				heap.Push(&largest, key)
+			}
+		}
+		b.mu.RUnlock()
+	}
+	db.mu.RUnlock()
+
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// keyHeap is a max-heap of keys.
+type keyHeap []string
+
+func (h keyHeap) Len() int           { return len(h) }
+func (h keyHeap) Less(i, j int) bool { return h[i] > h[j] }
+func (h keyHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *keyHeap) Push(x interface{}) {
+	*h = append(*h, x.(string))
+}
+
+func (h *keyHeap) Pop() interface{} {
+	old := *h
+	key := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return key
+}
+
+// Next moves the iterator to the next live key. It returns false when there
+// are no more keys or an error happened.
+func (it *Iterator) Next() bool {
+	for it.err == nil {
+		if it.pos == len(it.keys) {
+			if it.last {
+				return false
+			}
+			it.list()
+			continue
+		}
+		key := it.keys[it.pos]
+		it.pos++
+
+		pair, err := it.db.getType(key)
+		if err == ErrNotFound || pair.vType == "delete" {
+			continue
+		}
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.key, it.value = key, pair.value
+		return true
+	}
+	return false
+}
+
+func (it *Iterator) Key() string {
+	return it.key
+}
+
+func (it *Iterator) Value() string {
+	return it.value
+}
+
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Scan returns at most limit live keys that start with prefix and sort after
+// startAfter, in lexicographic order. A non-positive limit means no limit.
+func (db *Db) Scan(prefix, startAfter string, limit int) ([]string, error) {
+	var keys []string
+	// Keys are listed a page at a time, more pages are only needed when some
+	// keys of a page turn out to be deleted.
+	it := db.iterator(prefix, startAfter, limit)
+	for (limit <= 0 || len(keys) < limit) && it.Next() {
+		keys = append(keys, it.Key())
+	}
+	return keys, it.Err()
+}
@@ -0,0 +1,118 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestDb_Scan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-scan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.segmentSize = 50
+
+	for _, key := range []string{"user:3", "user:1", "item:1", "user:2", "user:4"} {
+		if err := db.Put(key, "old-"+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put("user:2", "new-user:2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("user:3"); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := db.Scan("user:", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []string{"user:1", "user:2", "user:4"}) {
+		t.Errorf("Unexpected keys %v", keys)
+	}
+
+	keys, err = db.Scan("user:", "user:1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []string{"user:2"}) {
+		t.Errorf("Unexpected page %v", keys)
+	}
+
+	it := db.Iterator("", "item:1")
+	var values []string
+	for it.Next() {
+		values = append(values, it.Key()+"="+it.Value())
+	}
+	if it.Err() != nil {
+		t.Fatal(it.Err())
+	}
+	expected := []string{"user:1=old-user:1", "user:2=new-user:2", "user:4=old-user:4"}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("Unexpected iteration result %v", values)
+	}
+}
+
+func TestDb_ScanPages(t *testing.T) {
+	db, err := NewDb(t.TempDir(), &Options{SegmentSize: 100, MergeThreshold: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var expected []string
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key%02d", i)
+		if err := db.Put(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+		// Overwritten keys are in the indexes of several segments.
+		if err := db.Put(key, "new-value"); err != nil {
+			t.Fatal(err)
+		}
+		if i > 0 && i < 6 {
+			if err := db.Delete(key); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		expected = append(expected, key)
+	}
+
+	// Deleted keys fill the first page, so more keys are listed to fill it.
+	keys, err := db.Scan("key", "", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []string{"key00", "key06", "key07"}) {
+		t.Errorf("Unexpected first page %v", keys)
+	}
+
+	var all []string
+	after := ""
+	for {
+		page, err := db.Scan("key", after, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		all = append(all, page...)
+		after = page[len(page)-1]
+	}
+	if !reflect.DeepEqual(all, expected) {
+		t.Errorf("Paging returned %v", all)
+	}
+}
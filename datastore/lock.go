@@ -0,0 +1,25 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// lockFileName is the file in the data directory locked by the Db that has
+// the directory open.
+const lockFileName = "LOCK"
+
+// ErrLocked is returned by NewDb when another Db holds the lock of the directory.
+var ErrLocked = fmt.Errorf("data directory is used by another process")
+
+// lockDir takes the exclusive lock of the directory. The lock is released
+// with unlockFile.
+func lockDir(dir string) (*os.File, error) {
+	f, err := lockFile(filepath.Join(dir, lockFileName))
+	if errors.Is(err, ErrLocked) {
+		return nil, fmt.Errorf("%w: %s", ErrLocked, dir)
+	}
+	return f, err
+}
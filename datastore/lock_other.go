@@ -0,0 +1,25 @@
+//go:build !unix
+
+package datastore
+
+import (
+	"os"
+)
+
+// lockFile creates the file exclusively. Without advisory locks the file
+// stays after a crash and has to be removed by hand.
+func lockFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o600)
+	if os.IsExist(err) {
+		return nil, ErrLocked
+	}
+	return f, err
+}
+
+func unlockFile(f *os.File) error {
+	err := f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Remove(f.Name())
+}
@@ -0,0 +1,219 @@
+package datastore
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Snapshot is a consistent view of the segment files at the moment it was
+// taken. It keeps the files open, so compaction may rename and remove them
+// without affecting the snapshot. A snapshot must be closed when it's no
+// longer needed.
+type Snapshot struct {
+	segments []snapshotSegment
+	taken    time.Time
+	position Position
+}
+
+type snapshotSegment struct {
+	name string
+	file *os.File
+	// size is the length of the acknowledged data. The active segment may
+	// grow after the snapshot, but only the first size bytes belong to it.
+	size int64
+}
+
+// Snapshot pins the sealed segments and the current end of the active one.
+// Writes that finish later are not visible in the snapshot.
+func (db *Db) Snapshot() (*Snapshot, error) {
+	// Writers hold the lock for reading until their record is indexed, so
+	// taking it exclusively waits for the writes in flight.
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// Records are added to the feed after they are written, so every record
+	// before the position is in the snapshot. Some records after it may be
+	// there as well; replaying them again doesn't change anything.
+	s := &Snapshot{taken: time.Now(), position: db.feed.head()}
+	for _, b := range db.blocks {
+		f, err := os.Open(b.outPath)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		b.mu.RLock()
+		size := b.outOffset
+		b.mu.RUnlock()
+		s.segments = append(s.segments, snapshotSegment{filepath.Base(b.outPath), f, size})
+	}
+	return s, nil
+}
+
+// Segments returns the names of the pinned segment files, oldest first.
+func (s *Snapshot) Segments() []string {
+	names := make([]string, len(s.segments))
+	for i, seg := range s.segments {
+		names[i] = seg.name
+	}
+	return names
+}
+
+// Position returns the change feed position a follower restored from the
+// snapshot should continue replication from.
+func (s *Snapshot) Position() Position {
+	return s.position
+}
+
+// Backup writes the pinned segments to w as a tar archive that Restore can load.
+func (s *Snapshot) Backup(w io.Writer) error {
+	tw := tar.NewWriter(w)
+	for _, seg := range s.segments {
+		err := tw.WriteHeader(&tar.Header{
+			Name:    seg.name,
+			Mode:    0o600,
+			Size:    seg.size,
+			ModTime: s.taken,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, io.NewSectionReader(seg.file, 0, seg.size))
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// Close releases the pinned segment files.
+func (s *Snapshot) Close() error {
+	var err error
+	for _, seg := range s.segments {
+		err = errors.Join(err, seg.file.Close())
+	}
+	s.segments = nil
+	return err
+}
+
+// Backup writes a consistent copy of the database to w while it keeps serving
+// reads and writes. See Snapshot.Backup for the format.
+func (db *Db) Backup(w io.Writer) error {
+	s, err := db.Snapshot()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	return s.Backup(w)
+}
+
+// Restore unpacks a backup made by Backup into dir, which must be empty or
+// not exist yet. The restored segments are checked with opts before Restore
+// returns, so the backup must come from a Db with the same segment prefix.
+func Restore(dir string, r io.Reader, opts *Options) error {
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	names, err := readDirNames(dir)
+	if err != nil {
+		return err
+	}
+	if len(names) != 0 {
+		return fmt.Errorf("cannot restore into non-empty directory %s", dir)
+	}
+
+	var checkOpts Options
+	if opts != nil {
+		checkOpts = *opts
+	}
+	checkOpts.Recovery = RecoverStrict
+	prefix := checkOpts.SegmentPrefix
+	if prefix == "" {
+		prefix = outFile
+	}
+	segmentName := segmentPattern(prefix)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg || !segmentName.MatchString(hdr.Name) {
+			return fmt.Errorf("unexpected file in backup: %s", hdr.Name)
+		}
+		err = restoreFile(filepath.Join(dir, hdr.Name), tr)
+		if err != nil {
+			return err
+		}
+	}
+
+	db, err := NewDb(dir, &checkOpts)
+	if err != nil {
+		return fmt.Errorf("restored backup is broken: %w", err)
+	}
+	return db.Close()
+}
+
+// Replace moves the files of the src directory, e.g. restored there by
+// Restore, into dir in place of its current content. It returns ErrLocked
+// if a Db has dir open. A crash in the middle may leave dir with a mix of
+// both, so the caller has to repeat the whole replacement.
+func Replace(dir, src string) error {
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	lock, err := lockDir(dir)
+	if err != nil {
+		return err
+	}
+	defer unlockFile(lock)
+
+	names, err := readDirNames(dir)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if name == lockFileName {
+			continue
+		}
+		err = os.RemoveAll(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+	}
+	names, err = readDirNames(src)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if name == lockFileName {
+			continue
+		}
+		err = os.Rename(filepath.Join(src, name), filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func restoreFile(path string, r io.Reader) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	return errors.Join(err, f.Close())
+}
@@ -0,0 +1,77 @@
+package datastore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestDb_Backup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(filepath.Join(dir, "db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// Compaction is run by hand once the snapshot is taken.
+	db.compaction.stop()
+	db.segmentSize = 100
+	for i := 0; i < 10; i++ {
+		if err := db.Put("key"+strconv.Itoa(i), "value"+strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snapshot, err := db.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snapshot.Close()
+	if len(snapshot.Segments()) < 3 {
+		t.Fatalf("Expected several segments, got %v", snapshot.Segments())
+	}
+
+	// Changes made after the snapshot, including a compaction that removes
+	// the pinned segment files, must not leak into the backup.
+	if err := db.Put("key0", "changed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("key1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	var backup bytes.Buffer
+	if err := snapshot.Backup(&backup); err != nil {
+		t.Fatal(err)
+	}
+	restoreDir := filepath.Join(dir, "restored")
+	if err := Restore(restoreDir, &backup, nil); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := NewDb(restoreDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	for i := 0; i < 10; i++ {
+		value, err := restored.Get("key" + strconv.Itoa(i))
+		if err != nil || value != "value"+strconv.Itoa(i) {
+			t.Errorf("Bad restored value for key%d: %s, %v", i, value, err)
+		}
+	}
+
+	if err := Restore(restoreDir, bytes.NewReader(nil), nil); err == nil {
+		t.Error("Expected restore into non-empty directory to fail")
+	}
+}
@@ -0,0 +1,94 @@
+package datastore
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+)
+
+// ErrVersionMismatch is returned by CompareAndSwap when the key has been changed by another writer.
+var ErrVersionMismatch = fmt.Errorf("version mismatch")
+
+// keyLockCount is the number of mutexes that serialize writes of keys with the same hash.
+const keyLockCount = 64
+
+func (db *Db) nextVersion() uint64 {
+	return db.seq.Add(1)
+}
+
+// lockKeys locks the mutexes guarding keys and returns a function unlocking them.
+// Mutexes are always taken in the same order, so writers can't deadlock.
+func (db *Db) lockKeys(keys ...string) func() {
+	var slots []int
+	seen := make(map[int]bool, len(keys))
+	for _, key := range keys {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		slot := int(h.Sum32() % keyLockCount)
+		if !seen[slot] {
+			seen[slot] = true
+			slots = append(slots, slot)
+		}
+	}
+	sort.Ints(slots)
+	for _, slot := range slots {
+		db.keyLocks[slot].Lock()
+	}
+	return func() {
+		for _, slot := range slots {
+			db.keyLocks[slot].Unlock()
+		}
+	}
+}
+
+// currentVersion returns the version of the newest live record of the key or 0 if there is none.
+func (db *Db) currentVersion(key string) (uint64, error) {
+	pair, err := db.getType(key)
+	if err == ErrNotFound || pair.vType == "delete" {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return pair.version, nil
+}
+
+// Version returns the version of the newest live record of the key, whatever
+// its type is. It returns ErrNotFound if there is no such key.
+func (db *Db) Version(key string) (uint64, error) {
+	version, err := db.currentVersion(key)
+	if err == nil && version == 0 {
+		return 0, ErrNotFound
+	}
+	return version, err
+}
+
+// GetWithVersion returns the value of the key along with its version.
+func (db *Db) GetWithVersion(key string) (string, uint64, error) {
+	pair, err := db.getType(key)
+	if err != nil {
+		return "", 0, err
+	}
+	if pair.vType == "delete" {
+		return "", 0, ErrNotFound
+	}
+	if pair.vType != "string" {
+		return "", 0, ErrWrongType
+	}
+	return pair.value, pair.version, nil
+}
+
+// CompareAndSwap stores the value only if the current version of the key is
+// expectedVersion and returns the new version. An expectedVersion of 0 means
+// that the key must not exist.
+func (db *Db) CompareAndSwap(key string, expectedVersion uint64, value string) (uint64, error) {
+	defer db.lockKeys(key)()
+	version, err := db.currentVersion(key)
+	if err != nil {
+		return 0, err
+	}
+	if version != expectedVersion {
+		return 0, ErrVersionMismatch
+	}
+	return db.putType(key, "string", value, 0)
+}
@@ -0,0 +1,103 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestDb_CompareAndSwap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-cas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v1, err := db.CompareAndSwap("key", 0, "value1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CompareAndSwap("key", 0, "value2"); err != ErrVersionMismatch {
+		t.Errorf("Expected version mismatch for existing key, got %v", err)
+	}
+	v2, err := db.CompareAndSwap("key", v1, "value2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v2 <= v1 {
+		t.Errorf("Version didn't grow: %d -> %d", v1, v2)
+	}
+	if _, err := db.CompareAndSwap("key", v1, "value3"); err != ErrVersionMismatch {
+		t.Errorf("Expected version mismatch for stale version, got %v", err)
+	}
+
+	value, version, err := db.GetWithVersion("key")
+	if err != nil || value != "value2" || version != v2 {
+		t.Errorf("Unexpected state: %s@%d, %v", value, version, err)
+	}
+	db.Close()
+
+	db, err = NewDb(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, version, _ := db.GetWithVersion("key"); version != v2 {
+		t.Errorf("Version was not recovered: %d vs %d", version, v2)
+	}
+	if err := db.Put("other", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if _, version, _ := db.GetWithVersion("other"); version <= v2 {
+		t.Errorf("Versions are reused after restart: %d", version)
+	}
+}
+
+func TestDb_CompareAndSwapConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-cas-concurrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	version, err := db.CompareAndSwap("counter", 0, "start")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		wins int
+	)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := db.CompareAndSwap("counter", version, "next")
+			if err == nil {
+				mu.Lock()
+				wins++
+				mu.Unlock()
+			} else if err != ErrVersionMismatch {
+				t.Errorf("Unexpected error: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if wins != 1 {
+		t.Errorf("Expected exactly one successful swap, got %d", wins)
+	}
+}
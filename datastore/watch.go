@@ -0,0 +1,199 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WatchBuffer is the number of events a watcher holds for its reader. A
+// watcher whose buffer is full is cut off.
+const WatchBuffer = 1024
+
+// WatchBatchWait is how long a watcher waits for its reader to make room for
+// the rest of a batch that didn't fit into the buffer.
+const WatchBatchWait = time.Second
+
+// ErrWatchLagging is returned by Watcher.Err when the reader didn't keep up
+// with the changes. Watching can be resumed with WatchFrom at Watcher.Position.
+var ErrWatchLagging = fmt.Errorf("watcher fell behind the changes")
+
+type EventType string
+
+const (
+	EventPut    EventType = "put"
+	EventDelete EventType = "delete"
+)
+
+// Event is a change of a single key.
+type Event struct {
+	Type    EventType
+	Key     string
+	Version uint64
+	// Position is the feed position of the record that made the change.
+	// Watching from it delivers the event again.
+	Position Position
+	// Last tells that the event is the last watched change of its record, so
+	// watching from the next position continues right after it. It's false
+	// for the other changes of a batch.
+	Last bool
+}
+
+// Watcher delivers changes of the keys with a prefix through the C channel.
+type Watcher struct {
+	// C is closed when the watcher stops, after which Err tells the reason.
+	C <-chan Event
+
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu  sync.Mutex
+	pos Position
+	err error
+}
+
+// Watch returns a watcher of the changes made to the keys with the prefix
+// from now on.
+func (db *Db) Watch(prefix string) *Watcher {
+	w, _ := db.WatchFrom(prefix, db.FeedPosition())
+	return w
+}
+
+// WatchFrom returns a watcher of the changes made since the feed position.
+// It returns ErrFeedGone if the position is no longer available.
+//
+// Changes are read from the change feed, so a slow reader never delays
+// writes. Instead, a watcher that can't hand an event over to its reader
+// stops with ErrWatchLagging. Events of a batch share its position, so
+// resuming in the middle of a batch repeats its first events. The reader gets
+// WatchBatchWait to take each event of a batch after the first one, so
+// batches larger than the buffer can be watched.
+func (db *Db) WatchFrom(prefix string, from Position) (*Watcher, error) {
+	_, _, err := db.feed.read(from, 0)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	events := make(chan Event, WatchBuffer)
+	w := &Watcher{C: events, cancel: cancel, done: make(chan struct{}), pos: from}
+	go w.run(ctx, db, prefix, events)
+	return w, nil
+}
+
+func (w *Watcher) run(ctx context.Context, db *Db, prefix string, events chan<- Event) {
+	defer close(w.done)
+	defer close(events)
+	pos := w.Position()
+	for {
+		records, err := db.ReadChanges(ctx, pos, WatchBuffer)
+		if err != nil {
+			w.stop(pos, err)
+			return
+		}
+		for _, data := range records {
+			var changes []Event
+			for _, ev := range recordEvents(data) {
+				if strings.HasPrefix(ev.Key, prefix) {
+					changes = append(changes, ev)
+				}
+			}
+			for i, ev := range changes {
+				ev.Position = pos
+				ev.Last = i == len(changes)-1
+				err = w.send(ctx, events, ev, i > 0)
+				if err != nil {
+					w.stop(pos, err)
+					return
+				}
+			}
+			pos.Index++
+			w.setPosition(pos)
+		}
+	}
+}
+
+// send hands the event over to the reader without waiting, unless the event
+// continues a record. Resuming repeats the whole record, so a batch with more
+// events than the buffer holds could never be delivered otherwise.
+func (w *Watcher) send(ctx context.Context, events chan<- Event, ev Event, wait bool) error {
+	select {
+	case events <- ev:
+		return nil
+	default:
+	}
+	if !wait {
+		return ErrWatchLagging
+	}
+	timer := time.NewTimer(WatchBatchWait)
+	defer timer.Stop()
+	select {
+	case events <- ev:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return ErrWatchLagging
+	}
+}
+
+// recordEvents returns the changes made by an encoded record of the feed.
+func recordEvents(data []byte) []Event {
+	var e entry
+	e.Decode(data)
+	if e.vType != BATCH_TYPE {
+		return []Event{entryEvent(&e)}
+	}
+	var events []Event
+	// Feed records were verified when written.
+	_ = batchRecords(data, func(_ int64, nested *entry) {
+		events = append(events, entryEvent(nested))
+	})
+	return events
+}
+
+func entryEvent(e *entry) Event {
+	ev := Event{Type: EventPut, Key: e.key, Version: e.version}
+	if e.vType == DELETE_TYPE {
+		ev.Type = EventDelete
+	}
+	return ev
+}
+
+func (w *Watcher) setPosition(pos Position) {
+	w.mu.Lock()
+	w.pos = pos
+	w.mu.Unlock()
+}
+
+func (w *Watcher) stop(pos Position, err error) {
+	w.mu.Lock()
+	w.pos = pos
+	if err != context.Canceled {
+		w.err = err
+	}
+	w.mu.Unlock()
+}
+
+// Position returns the feed position after the records whose events were
+// handed over to C. Once C is closed, it's the position to resume from.
+func (w *Watcher) Position() Position {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.pos
+}
+
+// Err returns the reason the watcher stopped: ErrWatchLagging, ErrFeedGone,
+// or nil if it was closed.
+func (w *Watcher) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// Close stops the watcher and closes its channel.
+func (w *Watcher) Close() {
+	w.cancel()
+	<-w.done
+}
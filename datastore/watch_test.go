@@ -0,0 +1,146 @@
+package datastore
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func nextEvent(t *testing.T, w *Watcher) Event {
+	t.Helper()
+	select {
+	case ev, ok := <-w.C:
+		if !ok {
+			t.Fatalf("Watcher stopped: %v", w.Err())
+		}
+		return ev
+	case <-time.After(time.Second):
+		t.Fatal("No event in time")
+	}
+	return Event{}
+}
+
+func TestDb_Watch(t *testing.T) {
+	db, err := NewDb(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	w := db.Watch("user:")
+	defer w.Close()
+	if err := db.Put("item:1", "x"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("user:1", "a"); err != nil {
+		t.Fatal(err)
+	}
+	batch := db.NewBatch()
+	batch.Put("user:2", "b")
+	batch.Delete("user:1")
+	if err := batch.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []Event{
+		{Type: EventPut, Key: "user:1", Last: true},
+		{Type: EventPut, Key: "user:2"},
+		{Type: EventDelete, Key: "user:1", Last: true},
+	} {
+		ev := nextEvent(t, w)
+		if ev.Type != expected.Type || ev.Key != expected.Key || ev.Last != expected.Last || ev.Version == 0 {
+			t.Errorf("Expected %s of %s, got %+v", expected.Type, expected.Key, ev)
+		}
+	}
+
+	w.Close()
+	if _, ok := <-w.C; ok {
+		t.Error("Expected the channel to be closed")
+	}
+	if w.Err() != nil {
+		t.Errorf("Unexpected error of a closed watcher: %v", w.Err())
+	}
+}
+
+func TestDb_WatchLagging(t *testing.T) {
+	db, err := NewDb(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	w := db.Watch("")
+	defer w.Close()
+	start := db.FeedPosition()
+	for i := 0; i < WatchBuffer+10; i++ {
+		if err := db.Put("key"+strconv.Itoa(i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Nothing is read, so the watcher is cut off once its buffer is full.
+	deadline := time.After(5 * time.Second)
+	for len(w.C) < WatchBuffer || w.Err() == nil {
+		select {
+		case <-deadline:
+			t.Fatalf("Watcher was not cut off, buffered %d, err %v", len(w.C), w.Err())
+		case <-time.After(time.Millisecond):
+		}
+	}
+	if w.Err() != ErrWatchLagging {
+		t.Fatalf("Expected ErrWatchLagging, got %v", w.Err())
+	}
+	for i := 0; i < WatchBuffer; i++ {
+		<-w.C
+	}
+	if _, ok := <-w.C; ok {
+		t.Error("Expected the channel to be closed after the buffered events")
+	}
+
+	pos := w.Position()
+	if pos.Index != start.Index+WatchBuffer {
+		t.Errorf("Expected resume position %d, got %d", start.Index+WatchBuffer, pos.Index)
+	}
+	resumed, err := db.WatchFrom("", pos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resumed.Close()
+	if ev := nextEvent(t, resumed); ev.Key != "key"+strconv.Itoa(WatchBuffer) {
+		t.Errorf("Resumed watcher started at %s", ev.Key)
+	}
+
+	if _, err := db.WatchFrom("", Position{Epoch: pos.Epoch + 1}); err != ErrFeedGone {
+		t.Errorf("Expected ErrFeedGone for a foreign epoch, got %v", err)
+	}
+}
+
+func TestDb_WatchLargeBatch(t *testing.T) {
+	db, err := NewDb(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	w := db.Watch("user:")
+	defer w.Close()
+	batch := db.NewBatch()
+	size := 2 * WatchBuffer
+	for i := 0; i < size; i++ {
+		batch.Put("user:"+strconv.Itoa(i), "value")
+	}
+	if err := batch.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A reader that keeps up gets the whole batch, though it doesn't fit into the buffer.
+	for i := 0; i < size; i++ {
+		ev := nextEvent(t, w)
+		if ev.Key != "user:"+strconv.Itoa(i) || ev.Last != (i == size-1) {
+			t.Fatalf("Unexpected event %d: %+v", i, ev)
+		}
+	}
+	if w.Err() != nil {
+		t.Errorf("Watcher stopped: %v", w.Err())
+	}
+}
@@ -0,0 +1,220 @@
+// Package dbclient is a client of the HTTP API of the db service.
+package dbclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultTimeout = 10 * time.Second
+	DefaultRetries = 2
+	DefaultBackoff = 100 * time.Millisecond
+)
+
+// Client calls a db service. It is safe for concurrent use.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	timeout    time.Duration
+	retries    int
+	backoff    time.Duration
+}
+
+type Option func(*Client)
+
+// WithHTTPClient makes the client send requests with hc instead of http.DefaultClient.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = hc
+	}
+}
+
+// WithTimeout limits the time of a single attempt of a call. Zero means that
+// only the context of the call limits it.
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.timeout = timeout
+	}
+}
+
+// WithRetries sets how many times an idempotent call is repeated after a
+// network error or a 5xx response. The pause before the n-th retry is n*backoff.
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.retries = retries
+		c.backoff = backoff
+	}
+}
+
+// New returns a client of the db service at baseURL, e.g. "http://db:8100".
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: http.DefaultClient,
+		timeout:    DefaultTimeout,
+		retries:    DefaultRetries,
+		backoff:    DefaultBackoff,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Get returns the string value of the key. It returns ErrWrongType if the
+// key holds a value of another type.
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	var resp struct {
+		Value json.RawMessage `json:"value"`
+	}
+	err := c.call(ctx, true, http.MethodGet, keyPath(key), nil, "", &resp)
+	if err != nil {
+		return "", err
+	}
+	var value string
+	if json.Unmarshal(resp.Value, &value) != nil {
+		return "", ErrWrongType
+	}
+	return value, nil
+}
+
+// Put saves the string value of the key. The value must not be empty.
+func (c *Client) Put(ctx context.Context, key, value string) error {
+	form := url.Values{"value": {value}}
+	return c.call(ctx, true, http.MethodPost, keyPath(key), []byte(form.Encode()), "application/x-www-form-urlencoded", nil)
+}
+
+// Delete removes the key. It returns ErrNotFound if there is no such key.
+// Delete is not retried: a repeated attempt would report ErrNotFound after
+// the first one has removed the key.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	return c.call(ctx, false, http.MethodDelete, keyPath(key), nil, "", nil)
+}
+
+// Scan returns up to limit keys that start with prefix and sort after the
+// after key. Zero limit means the server default.
+func (c *Client) Scan(ctx context.Context, prefix, after string, limit int) ([]string, error) {
+	query := url.Values{}
+	if prefix != "" {
+		query.Set("prefix", prefix)
+	}
+	if after != "" {
+		query.Set("after", after)
+	}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	path := "/db"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	var resp struct {
+		Keys []string `json:"keys"`
+	}
+	err := c.call(ctx, true, http.MethodGet, path, nil, "", &resp)
+	return resp.Keys, err
+}
+
+// Operation is a single write of a batch.
+type Operation struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+func PutOp(key, value string) Operation {
+	return Operation{Op: "put", Key: key, Value: value}
+}
+
+func DeleteOp(key string) Operation {
+	return Operation{Op: "delete", Key: key}
+}
+
+// Batch applies all operations atomically and returns the number of applied operations.
+func (c *Client) Batch(ctx context.Context, ops []Operation) (int, error) {
+	body, err := json.Marshal(struct {
+		Operations []Operation `json:"operations"`
+	}{ops})
+	if err != nil {
+		return 0, err
+	}
+	var resp struct {
+		Applied int `json:"applied"`
+	}
+	err = c.call(ctx, false, http.MethodPost, "/db/_batch", body, "application/json", &resp)
+	return resp.Applied, err
+}
+
+func keyPath(key string) string {
+	return "/db/" + url.PathEscape(key)
+}
+
+// call sends the request, retrying it if idempotent is set, and decodes a
+// successful JSON response into out unless it's nil.
+func (c *Client) call(ctx context.Context, idempotent bool, method, path string, body []byte, contentType string, out interface{}) error {
+	attempts := 1
+	if idempotent {
+		attempts += c.retries
+	}
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Duration(attempt) * c.backoff):
+			}
+		}
+		var retry bool
+		retry, err = c.do(ctx, method, path, body, contentType, out)
+		if !retry || ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// do makes a single attempt of a call. It reports whether a failed attempt
+// may succeed if repeated.
+func (c *Client) do(ctx context.Context, method, path string, body []byte, contentType string, out interface{}) (bool, error) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return resp.StatusCode >= 500, readError(resp)
+	}
+	if out == nil {
+		_, err = io.Copy(io.Discard, resp.Body)
+		return false, err
+	}
+	err = json.NewDecoder(resp.Body).Decode(out)
+	if err != nil {
+		return false, fmt.Errorf("bad response of the db service: %w", err)
+	}
+	return false, nil
+}
@@ -0,0 +1,103 @@
+package dbclient
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClient_Retries(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = rw.Write([]byte(`{"key":"k","value":"v"}`))
+	}))
+	defer server.Close()
+	ctx := context.Background()
+
+	client := New(server.URL, WithRetries(2, time.Millisecond))
+	value, err := client.Get(ctx, "k")
+	if err != nil || value != "v" {
+		t.Errorf("Expected the third attempt to succeed, got %q, %v", value, err)
+	}
+	if n := calls.Load(); n != 3 {
+		t.Errorf("Expected 3 attempts, got %d", n)
+	}
+
+	calls.Store(0)
+	client = New(server.URL, WithRetries(1, time.Millisecond))
+	_, err = client.Get(ctx, "k")
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.Status != http.StatusServiceUnavailable {
+		t.Errorf("Expected a 503 error, got %v", err)
+	}
+
+	calls.Store(0)
+	err = client.Delete(ctx, "k")
+	if err == nil {
+		t.Errorf("Expected Delete to fail")
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("Delete must not be retried, got %d attempts", n)
+	}
+}
+
+func TestClient_NoRetryOnClientErrors(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusPreconditionFailed)
+		_, _ = rw.Write([]byte(`{"error":{"code":"precondition_failed","message":"Precondition failed"}}`))
+	}))
+	defer server.Close()
+
+	err := New(server.URL, WithRetries(3, time.Millisecond)).Put(context.Background(), "k", "v")
+	if !errors.Is(err, ErrPreconditionFailed) {
+		t.Errorf("Expected ErrPreconditionFailed, got %v", err)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("Expected a single attempt, got %d", n)
+	}
+}
+
+func TestClient_Timeout(t *testing.T) {
+	release := make(chan struct{})
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+			return
+		}
+		_, _ = rw.Write([]byte(`{"keys":["a"]}`))
+	}))
+	defer server.Close()
+	defer close(release)
+
+	client := New(server.URL, WithTimeout(50*time.Millisecond), WithRetries(1, time.Millisecond))
+	keys, err := client.Scan(context.Background(), "", "", 0)
+	if err != nil || len(keys) != 1 {
+		t.Errorf("Expected the slow attempt to be retried, got %v, %v", keys, err)
+	}
+
+	calls.Store(0)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = New(server.URL, WithRetries(3, time.Millisecond)).Scan(ctx, "", "", 0)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the call deadline to stop it, got %v", err)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("Expected no retries after the call deadline, got %d attempts", n)
+	}
+}
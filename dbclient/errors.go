@@ -0,0 +1,77 @@
+package dbclient
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Errors matching the codes of the db service error responses. An *Error
+// returned by a call wraps one of them, so they can be checked with errors.Is.
+var (
+	ErrBadRequest         = errors.New("bad request")
+	ErrNotFound           = errors.New("record does not exist")
+	ErrMethodNotAllowed   = errors.New("method not allowed")
+	ErrWrongType          = errors.New("wrong value type")
+	ErrOverflow           = errors.New("integer overflow")
+	ErrPreconditionFailed = errors.New("precondition failed")
+	ErrValueTooLarge      = errors.New("value too large")
+	ErrFeedGone           = errors.New("change feed position is no longer available")
+	ErrCorruptRecord      = errors.New("corrupt record")
+	ErrInternal           = errors.New("internal error")
+)
+
+var codeErrors = map[string]error{
+	"bad_request":         ErrBadRequest,
+	"not_found":           ErrNotFound,
+	"method_not_allowed":  ErrMethodNotAllowed,
+	"wrong_type":          ErrWrongType,
+	"overflow":            ErrOverflow,
+	"precondition_failed": ErrPreconditionFailed,
+	"value_too_large":     ErrValueTooLarge,
+	"feed_gone":           ErrFeedGone,
+	"corrupt_record":      ErrCorruptRecord,
+	"internal":            ErrInternal,
+}
+
+// Error is an error response of the db service.
+type Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("db service: %d %s", e.Status, e.Message)
+	}
+	return fmt.Sprintf("db service: %s: %s", e.Code, e.Message)
+}
+
+// Unwrap returns the error matching the code of the response, or nil for
+// unknown codes.
+func (e *Error) Unwrap() error {
+	return codeErrors[e.Code]
+}
+
+// readError builds the error of a failed response. Responses without a JSON
+// error body, e.g. from a proxy, keep the status text as the message.
+func readError(resp *http.Response) error {
+	e := &Error{Status: resp.StatusCode, Message: http.StatusText(resp.StatusCode)}
+	var body struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err == nil && json.Unmarshal(data, &body) == nil && body.Error.Code != "" {
+		e.Code = body.Error.Code
+		e.Message = body.Error.Message
+	} else if resp.StatusCode == http.StatusNotFound {
+		e.Code = "not_found"
+	}
+	return e
+}